@@ -6,32 +6,62 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
-	_ "net/http/pprof" 
+	_ "net/http/pprof"
 	"net/url"
+	"os"
 	"reflect"
 	"runtime"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/config"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/encryption"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/httpp"
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/middleware"
+	pb "github.com/SiberianMonster/go-musthave-devops-tpl/internal/proto"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/tlsconfig"
 	"github.com/shirou/gopsutil/v3/mem"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 )
 
-var host, key, buildVersion, buildDate, buildCommit *string
-var pollCounterEnv, reportCounterEnv string
+var host, key, token, cryptoKey, tlsCA, tlsCert, tlsKey, pollCounterEnv, reportCounterEnv, instanceID, transport, buildVersion, buildDate, buildCommit *string
+var publicKey *rsa.PublicKey
+
+// realIP is the address of the interface the agent reaches the server from, it is sent in the X-Real-IP header.
+var realIP string
+
+// scheme and httpClient are switched to https and the client with the TLS configuration by UseTLS.
+var scheme = "http"
+var httpClient = http.DefaultClient
 var rtm runtime.MemStats
 var v reflect.Value
 var typeOfS reflect.Type
 var err error
 
+// Transports available for posting the collected stats to the server.
+// With the http transport the stats are posted in a single batch to the /updates/ endpoint.
+// With the gRPC transport the ADDRESS value is the address of the server gRPC service.
+const (
+	TransportHTTP = "http"
+	TransportGRPC = "grpc"
+)
+
 // LockMetricsContainer is a struct that serves to store and transmit system metrics.
 // It contains RMutex attribute to avoid data corruption.
 type LockMetricsContainer struct {
@@ -43,8 +73,13 @@ var Lm LockMetricsContainer
 
 // CounterCheck function controls variables used as intervals for system metrics collection and posting.
 // The function checks that the posting interval is always larger than the collection interval.
-func CounterCheck(pollCounterVar int, reportCounterVar int) error {
+func CounterCheck(pollCounterVar time.Duration, reportCounterVar time.Duration) error {
 
+	if pollCounterVar <= 0 {
+		err = errors.New("pollduration needs to be positive")
+		log.Printf("Error happened in setting timer. Err: %s", err)
+		return err
+	}
 	if pollCounterVar >= reportCounterVar {
 		err = errors.New("reportduration needs to be larger than pollduration")
 		log.Printf("Error happened in setting timer. Err: %s", err)
@@ -80,11 +115,17 @@ func SendMemStats(metricsObj metrics.Metrics, urlString string) {
 
 	body, err := json.Marshal(metricsObj)
 	if err != nil {
-			log.Printf("Error happened in JSON marshal. Err: %s", err)
+		log.Printf("Error happened in JSON marshal. Err: %s", err)
 	}
 	log.Print(string(body))
 
-	response, err := http.Post(urlString, "application/json", bytes.NewBuffer(body))
+	request, err := NewRequest(urlString, body)
+	if err != nil {
+		log.Printf("Error happened when request made. Err: %s", err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := httpClient.Do(request)
 	if err != nil {
 		log.Printf("Error happened when response received. Err: %s", err)
 		return
@@ -99,6 +140,86 @@ func SendMemStats(metricsObj metrics.Metrics, urlString string) {
 	log.Printf("Status code %q\n", response.Status)
 }
 
+// NewRequest function returns the POST request with the body encrypted with the server public key.
+// The body is sent unchanged when the public key is not set. The agent address is set in the X-Real-IP header
+// and the agent token in the Authorization header.
+func NewRequest(urlString string, body []byte) (*http.Request, error) {
+
+	var err error
+	if publicKey != nil {
+		if body, err = encryption.Encrypt(publicKey, body); err != nil {
+			return nil, err
+		}
+	}
+	request, err := http.NewRequest(http.MethodPost, urlString, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if publicKey != nil {
+		request.Header.Set(encryption.Header, encryption.Scheme)
+	}
+	if realIP != "" {
+		request.Header.Set(middleware.RealIPHeader, realIP)
+	}
+	if *token != "" {
+		request.Header.Set("Authorization", "Bearer "+*token)
+	}
+	return request, nil
+}
+
+// CheckResponseHash function verifies the HashSHA256 header of the server response against its body.
+// The body is read and replaced, so it can still be read by the caller.
+func CheckResponseHash(response *http.Response, key string) error {
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	if !hmac.Equal([]byte(httpp.BodyHash(body, key)), []byte(response.Header.Get(middleware.HashHeader))) {
+		return errors.New("response body hash does not match")
+	}
+	return nil
+}
+
+// OutboundIP function returns the address of the interface used to reach the server.
+// No packets are sent, connecting the UDP socket only selects the route.
+func OutboundIP(address string) (net.IP, error) {
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// InstanceLabels function returns the labels identifying the agent, which are attached to every reported metric.
+func InstanceLabels() map[string]string {
+
+	if *instanceID == "" {
+		return nil
+	}
+	return map[string]string{metrics.InstanceLabel: *instanceID}
+}
+
+// ResolveInstanceID function returns the configured instance ID or the host name when it is not set.
+func ResolveInstanceID(configured string) (string, error) {
+
+	if configured != "" {
+		return configured, nil
+	}
+	return os.Hostname()
+}
+
+// UseTLS function makes the agent post the stats over https with the TLS configuration.
+func UseTLS(tlsConfig *tls.Config) {
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	scheme = "https"
+	httpClient = &http.Client{Transport: tr}
+}
 
 // ReportStats writes collected each system metric as a request body and posts them to the server.
 func ReportStats() {
@@ -113,7 +234,7 @@ func ReportStats() {
 	for i := 0; i < v.NumField(); i++ {
 
 		url := url.URL{
-			Scheme: "http",
+			Scheme: scheme,
 			Host:   *host,
 		}
 		url.Path += "update/"
@@ -123,6 +244,7 @@ func ReportStats() {
 		if v.Field(i).Kind() == reflect.Float64 {
 			metricsObj.ID = typeOfS.Field(i).Name
 			metricsObj.MType = metrics.Gauge
+			metricsObj.Labels = InstanceLabels()
 			value := v.Field(i).Interface().(float64)
 			metricsObj.Value = &value
 			if *key != "" {
@@ -132,6 +254,7 @@ func ReportStats() {
 		} else {
 			metricsObj.ID = typeOfS.Field(i).Name
 			metricsObj.MType = metrics.Counter
+			metricsObj.Labels = InstanceLabels()
 			delta := v.Field(i).Interface().(int64)
 			metricsObj.Delta = &delta
 			if *key != "" {
@@ -145,9 +268,124 @@ func ReportStats() {
 
 }
 
-// ReportUpdateBatch allows to send all collected metrics in a single http request. 
+// StatsBatch function returns the collected system metrics as a slice of metrics objects signed with the key.
+func StatsBatch() []metrics.Metrics {
+
+	Lm.mu.RLock()
+	defer Lm.mu.RUnlock()
+	v := reflect.ValueOf(Lm.m)
+	typeOfS := v.Type()
+
+	metricsBatch := make([]metrics.Metrics, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+
+		metricsObj := metrics.Metrics{ID: typeOfS.Field(i).Name, Labels: InstanceLabels()}
+		if v.Field(i).Kind() == reflect.Float64 {
+			metricsObj.MType = metrics.Gauge
+			value := v.Field(i).Interface().(float64)
+			metricsObj.Value = &value
+		} else {
+			metricsObj.MType = metrics.Counter
+			delta := v.Field(i).Interface().(int64)
+			metricsObj.Delta = &delta
+		}
+		if *key != "" {
+			metricsObj.Hash = metrics.MetricsHash(metricsObj, *key)
+		}
+		metricsBatch = append(metricsBatch, metricsObj)
+	}
+	return metricsBatch
+}
+
+// ReportBatch sends the collected system metrics to the server in a single http request.
+func ReportBatch() error {
+
+	log.Println("Reporting stats batch")
+
+	url := url.URL{
+		Scheme: scheme,
+		Host:   *host,
+		Path:   "updates/",
+	}
+	if err := SendBatch(url.String(), StatsBatch()); err != nil {
+		log.Printf("Error happened when posting metrics batch. Err: %s", err)
+		return err
+	}
+	return nil
+}
+
+// SendBatch function posts the batch of system metrics compressed with gzip and encrypted with the server public key.
+// With the key set the plain body is signed in the HashSHA256 header and the signature of the response is verified.
+func SendBatch(urlString string, metricsBatch []metrics.Metrics) error {
+
+	body, err := json.Marshal(metricsBatch)
+	if err != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", err)
+		return err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(body)
+	if err = gz.Close(); err != nil {
+		return err
+	}
+
+	// the body is compressed before the encryption, the encrypted data does not compress
+	request, err := NewRequest(urlString, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Content-Encoding", "gzip")
+	if *key != "" {
+		// the hash covers the plain body, the server checks it after the decryption and decompression
+		request.Header.Set(middleware.HashHeader, httpp.BodyHash(body, *key))
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	log.Printf("Status code %q\n", response.Status)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("batch rejected with status %s", response.Status)
+	}
+	if *key != "" {
+		return CheckResponseHash(response, *key)
+	}
+	return nil
+}
+
+// ReportStatsGRPC sends the collected system metrics to the server gRPC service in a single batch.
+func ReportStatsGRPC(client pb.MetricsClient) error {
+
+	log.Println("Reporting stats over gRPC")
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ContextSrvTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	if realIP != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, middleware.RealIPHeader, realIP)
+	}
+	if *token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+*token)
+	}
+	resp, err := client.UpdateBatch(ctx, &pb.UpdateBatchRequest{Metrics: pb.FromMetricsBatch(StatsBatch())})
+	if err != nil {
+		log.Printf("Error happened when posting metrics over gRPC. Err: %s", err)
+		return err
+	}
+	log.Printf("Accepted %d metrics", resp.GetAccepted())
+	return nil
+}
+
+// ReportUpdateBatch allows to send all collected metrics in a single http request.
 // All the metrics are appended to a single slice of metrics objects.
-func ReportUpdateBatch(pollCounterVar int, reportCounterVar int) error {
+func ReportUpdateBatch(pollCounterVar time.Duration, reportCounterVar time.Duration) error {
 
 	var m metrics.MetricsContainer
 	var rtm runtime.MemStats
@@ -155,17 +393,14 @@ func ReportUpdateBatch(pollCounterVar int, reportCounterVar int) error {
 	var typeOfS reflect.Type
 	var err error
 
-	if pollCounterVar >= reportCounterVar {
-		err = errors.New("reportduration needs to be larger than pollduration")
+	if err = CounterCheck(pollCounterVar, reportCounterVar); err != nil {
 		return err
-
 	}
 
-	pollTicker := time.NewTicker(time.Second * time.Duration(pollCounterVar))
-	reportTicker := time.NewTicker(time.Second * time.Duration(reportCounterVar))
+	pollTicker := time.NewTicker(pollCounterVar)
+	reportTicker := time.NewTicker(reportCounterVar)
 
 	m.PollCount = 0
-	client := &http.Client{}
 
 	for {
 
@@ -180,7 +415,7 @@ func ReportUpdateBatch(pollCounterVar int, reportCounterVar int) error {
 			// send stats to the server
 
 			url := url.URL{
-				Scheme: "http",
+				Scheme: scheme,
 				Host:   *host,
 			}
 			url.Path += "updates/"
@@ -193,6 +428,7 @@ func ReportUpdateBatch(pollCounterVar int, reportCounterVar int) error {
 				if v.Field(i).Kind() == reflect.Float64 {
 					metricsObj.ID = typeOfS.Field(i).Name
 					metricsObj.MType = metrics.Gauge
+					metricsObj.Labels = InstanceLabels()
 					value := v.Field(i).Interface().(float64)
 					metricsObj.Value = &value
 					if *key != "" {
@@ -202,6 +438,7 @@ func ReportUpdateBatch(pollCounterVar int, reportCounterVar int) error {
 				} else {
 					metricsObj.ID = typeOfS.Field(i).Name
 					metricsObj.MType = metrics.Counter
+					metricsObj.Labels = InstanceLabels()
 					delta := v.Field(i).Interface().(int64)
 					metricsObj.Delta = &delta
 					if *key != "" {
@@ -211,40 +448,9 @@ func ReportUpdateBatch(pollCounterVar int, reportCounterVar int) error {
 				metricsBatch = append(metricsBatch, metricsObj)
 			}
 			if len(metricsBatch) > 0 {
-				body, err := json.Marshal(metricsBatch)
-				if err != nil {
-					log.Printf("Error happened in JSON marshal. Err: %s", err)
-					return err
-				}
-				log.Print(string(body))
-
-				var buf bytes.Buffer
-				gz := gzip.NewWriter(&buf)
-				gz.Write(body)
-				gz.Close()
-
-				request, err := http.NewRequest(http.MethodPost, url.String(), &buf)
-				if err != nil {
-					log.Fatalf("Error happened when request made. Err: %s", err)
-				}
-
-				request.Header.Set("Content-Type", "application/json")
-				request.Header.Set("Accept", "application/json")
-				request.Header.Set("Content-Encoding", "gzip")
-				response, err := client.Do(request)
-				if err != nil {
-					log.Printf("Error happened when response received. Err: %s", err)
-					continue
-
+				if err := SendBatch(url.String(), metricsBatch); err != nil {
+					log.Printf("Error happened when posting metrics batch. Err: %s", err)
 				}
-				err = response.Body.Close()
-				if err != nil {
-					log.Printf("Error happened when response body closed. Err: %s", err)
-					continue
-				}
-				// response status
-				log.Printf("Status code %q\n", response.Status)
-
 			}
 
 		}
@@ -255,9 +461,16 @@ func ReportUpdateBatch(pollCounterVar int, reportCounterVar int) error {
 func init() {
 
 	host = config.GetEnv("ADDRESS", flag.String("a", "127.0.0.1:8080", "ADDRESS"))
-	pollCounterEnv = strings.Replace(*config.GetEnv("POLL_INTERVAL", flag.String("p", "2", "POLL_INTERVAL")), "s", "", -1)
-	reportCounterEnv = strings.Replace(*config.GetEnv("REPORT_INTERVAL", flag.String("r", "10", "REPORT_INTERVAL")), "s", "", -1)
+	pollCounterEnv = config.GetEnv("POLL_INTERVAL", flag.String("p", "2s", "POLL_INTERVAL"))
+	reportCounterEnv = config.GetEnv("REPORT_INTERVAL", flag.String("r", "10s", "REPORT_INTERVAL"))
 	key = config.GetEnv("KEY", flag.String("k", "", "KEY"))
+	token = config.GetEnv("TOKEN", flag.String("token", "", "TOKEN"))
+	cryptoKey = config.GetEnv("CRYPTO_KEY", flag.String("crypto-key", "", "CRYPTO_KEY"))
+	tlsCA = config.GetEnv("TLS_CA", flag.String("tls-ca", "", "TLS_CA"))
+	tlsCert = config.GetEnv("TLS_CERT", flag.String("tls-cert", "", "TLS_CERT"))
+	tlsKey = config.GetEnv("TLS_KEY", flag.String("tls-key", "", "TLS_KEY"))
+	instanceID = config.GetEnv("INSTANCE_ID", flag.String("id", "", "INSTANCE_ID"))
+	transport = config.GetEnv("TRANSPORT", flag.String("transport", TransportHTTP, "TRANSPORT"))
 	buildVersion = config.GetEnv("BUILD_VERSION", flag.String("bv", "N/A", "BUILD_VERSION"))
 	buildDate = config.GetEnv("BUILD_DATE", flag.String("bd", "N/A", "BUILD_DATE"))
 	buildCommit = config.GetEnv("BUILD_COMMIT", flag.String("bc", "N/A", "BUILD_COMMIT"))
@@ -270,12 +483,45 @@ func main() {
 
 	flag.Parse()
 
-	pollCounterVar, err := strconv.Atoi(pollCounterEnv)
+	id, err := ResolveInstanceID(*instanceID)
+	if err != nil {
+		log.Fatalf("Error happened in reading host name for instance ID. Err: %s", err)
+	}
+	instanceID = &id
+	log.Printf("Reporting as instance %s", *instanceID)
+
+	if ip, err := OutboundIP(*host); err != nil {
+		log.Printf("Error happened in detecting the agent address, X-Real-IP is not sent. Err: %s", err)
+	} else {
+		realIP = ip.String()
+		log.Printf("Reporting from address %s", realIP)
+	}
+
+	if len(*cryptoKey) > 0 {
+		if publicKey, err = encryption.ReadPublicKey(*cryptoKey); err != nil {
+			log.Fatalf("Error happened in reading crypto key %s. Err: %s", *cryptoKey, err)
+		}
+		if *transport == TransportGRPC {
+			log.Printf("The crypto key is used by the http transport only, use TLS to protect the gRPC requests")
+		}
+	}
+
+	creds := insecure.NewCredentials()
+	if len(*tlsCA) > 0 || len(*tlsCert) > 0 || len(*tlsKey) > 0 {
+		tlsConfig, err := tlsconfig.ClientConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Error happened in reading TLS configuration. Err: %s", err)
+		}
+		UseTLS(tlsConfig)
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	pollCounterVar, err := config.ParseDuration(*pollCounterEnv)
 	if err != nil {
 		log.Fatalf("Error happened in reading poll counter variable. Err: %s", err)
 	}
 
-	reportCounterVar, err := strconv.Atoi(reportCounterEnv)
+	reportCounterVar, err := config.ParseDuration(*reportCounterEnv)
 	if err != nil {
 		log.Fatalf("Error happened in reading report counter variable. Err: %s", err)
 	}
@@ -285,8 +531,23 @@ func main() {
 		log.Fatalf("Error happened in checking counter variables. Err: %s", err)
 	}
 
-	pollTicker := time.NewTicker(time.Second * time.Duration(pollCounterVar))
-	reportTicker := time.NewTicker(time.Second * time.Duration(reportCounterVar))
+	report := func() { ReportBatch() }
+	switch *transport {
+	case TransportHTTP:
+	case TransportGRPC:
+		conn, err := grpc.Dial(*host, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			log.Fatalf("Error happened when connecting to the gRPC server. Err: %s", err)
+		}
+		defer conn.Close()
+		client := pb.NewMetricsClient(conn)
+		report = func() { ReportStatsGRPC(client) }
+	default:
+		log.Fatalf("Error happened in reading transport variable. Err: unknown transport %q", *transport)
+	}
+
+	pollTicker := time.NewTicker(pollCounterVar)
+	reportTicker := time.NewTicker(reportCounterVar)
 
 	for {
 
@@ -298,7 +559,7 @@ func main() {
 
 		case <-reportTicker.C:
 			// send stats to the server
-			go ReportStats()
+			go report()
 		}
 	}
 
@@ -1,11 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
 	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
 	"testing"
+	"time"
 
-	"github.com/stretchr/testify/assert"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/encryption"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/handlers"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/httpp"
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/middleware"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/storage"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/tlsconfig"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/tlsconfig/tlstest"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCounterCheck(t *testing.T) {
@@ -14,26 +35,34 @@ func TestCounterCheck(t *testing.T) {
 	}
 	tests := []struct {
 		name           string
-		pollduration   int
-		reportduration int
+		pollduration   time.Duration
+		reportduration time.Duration
 		want           want
 	}{
 		{
 			name:           "equal poll report test #1",
-			pollduration:   3,
-			reportduration: 3,
+			pollduration:   3 * time.Second,
+			reportduration: 3 * time.Second,
 			want: want{
 				errvalue: errors.New("reportduration needs to be larger than pollduration"),
 			},
 		},
 		{
 			name:           "large poll test #2",
-			pollduration:   6,
-			reportduration: 3,
+			pollduration:   6 * time.Second,
+			reportduration: 3 * time.Second,
 			want: want{
 				errvalue: errors.New("reportduration needs to be larger than pollduration"),
 			},
 		},
+		{
+			name:           "zero poll test #3",
+			pollduration:   0,
+			reportduration: 500 * time.Millisecond,
+			want: want{
+				errvalue: errors.New("pollduration needs to be positive"),
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -50,22 +79,22 @@ func TestReportUpdateBatch(t *testing.T) {
 	}
 	tests := []struct {
 		name           string
-		pollduration   int
-		reportduration int
+		pollduration   time.Duration
+		reportduration time.Duration
 		want           want
 	}{
 		{
 			name:           "equal poll report test #1",
-			pollduration:   3,
-			reportduration: 3,
+			pollduration:   3 * time.Second,
+			reportduration: 3 * time.Second,
 			want: want{
 				errvalue: errors.New("reportduration needs to be larger than pollduration"),
 			},
 		},
 		{
 			name:           "large poll test #2",
-			pollduration:   6,
-			reportduration: 3,
+			pollduration:   6 * time.Second,
+			reportduration: 3 * time.Second,
 			want: want{
 				errvalue: errors.New("reportduration needs to be larger than pollduration"),
 			},
@@ -131,19 +160,156 @@ func TestReportStats(t *testing.T) {
 	}
 }
 
+func TestStatsBatch(t *testing.T) {
+
+	CollectStats()
+	batch := StatsBatch()
+	assert.Len(t, batch, reflect.TypeOf(metrics.MetricsContainer{}).NumField())
+	for _, mp := range batch {
+		if mp.ID == "PollCount" {
+			assert.Equal(t, metrics.Counter, mp.MType)
+			assert.NotNil(t, mp.Delta)
+		}
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	body := []byte(`{"id":"Alloc","type":"gauge","value":1}`)
+
+	request, err := NewRequest("http://127.0.0.1:8080/update/", body)
+	require.NoError(t, err)
+	assert.Empty(t, request.Header.Get(encryption.Header))
+	assert.Empty(t, request.Header.Get(middleware.RealIPHeader))
+
+	realIP = "192.168.1.10"
+	*token = "secret"
+	defer func() { realIP, *token = "", "" }()
+
+	publicKey = &priv.PublicKey
+	defer func() { publicKey = nil }()
+	request, err = NewRequest("http://127.0.0.1:8080/update/", body)
+	require.NoError(t, err)
+	assert.Equal(t, encryption.Scheme, request.Header.Get(encryption.Header))
+	assert.Equal(t, realIP, request.Header.Get(middleware.RealIPHeader))
+	assert.Equal(t, "Bearer secret", request.Header.Get("Authorization"))
+	message, err := io.ReadAll(request.Body)
+	require.NoError(t, err)
+	plaintext, err := encryption.Decrypt(priv, message)
+	require.NoError(t, err)
+	assert.Equal(t, body, plaintext)
+}
+
+func TestReportBatchSigned(t *testing.T) {
+
+	// the server side of /updates/ is composed the same way as in the server router
+	const secret = "secret"
+	st := storage.NewMemStorage()
+	r := mux.NewRouter()
+	r.Handle("/updates/", middleware.HashHandler(secret)(http.HandlerFunc(handlers.NewWrapperJSONStruct(st, secret).UpdateBatchJSONHandler)))
+	r.Use(middleware.GzipHandler)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	serverURL, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	defer func(h, k string) { *host, *key = h, k }(*host, *key)
+	*host, *key = serverURL.Host, secret
+
+	CollectStats()
+	require.NoError(t, ReportBatch())
+	mp, err := st.Get(context.Background(), metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Labels: InstanceLabels()})
+	require.NoError(t, err)
+	assert.NotNil(t, mp.Delta)
+
+	// the server rejects the batch signed with another key
+	*key = "other"
+	assert.Error(t, ReportBatch())
+}
+
+func TestCheckResponseHash(t *testing.T) {
+
+	body := []byte(`{"status":"ok"}`)
+	tests := []struct {
+		name    string
+		hash    string
+		wantErr bool
+	}{
+		{name: "signed", hash: httpp.BodyHash(body, "secret")},
+		{name: "wrong key", hash: httpp.BodyHash(body, "other"), wantErr: true},
+		{name: "unsigned", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := &http.Response{Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(body))}
+			response.Header.Set(middleware.HashHeader, tt.hash)
+			err := CheckResponseHash(response, "secret")
+			assert.Equal(t, tt.wantErr, err != nil)
+			read, err := io.ReadAll(response.Body)
+			require.NoError(t, err)
+			assert.Equal(t, body, read)
+		})
+	}
+}
+
+func TestOutboundIP(t *testing.T) {
+
+	ip, err := OutboundIP("127.0.0.1:8080")
+	require.NoError(t, err)
+	assert.True(t, ip.IsLoopback())
+
+	_, err = OutboundIP("127.0.0.1")
+	assert.Error(t, err)
+}
+
+func TestUseTLS(t *testing.T) {
+
+	files := tlstest.NewFiles(t)
+	serverConfig, err := tlsconfig.ServerConfig(files.ServerCert, files.ServerKey, files.CA)
+	require.NoError(t, err)
+	received := make(chan metrics.Metrics, 1)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var mp metrics.Metrics
+		json.NewDecoder(r.Body).Decode(&mp)
+		received <- mp
+	}))
+	ts.TLS = serverConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	clientConfig, err := tlsconfig.ClientConfig(files.CA, files.ClientCert, files.ClientKey)
+	require.NoError(t, err)
+	defer func(s string, c *http.Client) { scheme, httpClient = s, c }(scheme, httpClient)
+	UseTLS(clientConfig)
+	assert.Equal(t, "https", scheme)
+
+	serverURL, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	u := url.URL{Scheme: scheme, Host: serverURL.Host, Path: "update/"}
+	SendMemStats(metrics.Metrics{ID: "Alloc", MType: metrics.Gauge}, u.String())
+	select {
+	case mp := <-received:
+		assert.Equal(t, "Alloc", mp.ID)
+	default:
+		t.Fatal("the server received no metrics")
+	}
+}
+
 func TestSendMemStats(t *testing.T) {
 
 	tests := []struct {
-		name           string
+		name      string
 		urlString string
 	}{
 		{
-			name: "trial run",
+			name:      "trial run",
 			urlString: "",
 		},
 	}
 	for _, tt := range tests {
-		metricsObj:= metrics.Metrics{}
+		metricsObj := metrics.Metrics{}
 		t.Run(tt.name, func(t *testing.T) {
 			SendMemStats(metricsObj, tt.urlString)
 
@@ -151,7 +317,6 @@ func TestSendMemStats(t *testing.T) {
 	}
 }
 
-
 func ExampleCollectStats() {
 
 	CollectStats()
@@ -169,3 +334,26 @@ func ExampleReportStats() {
 	ReportStats()
 
 }
+
+func TestResolveInstanceID(t *testing.T) {
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		name       string
+		configured string
+		want       string
+	}{
+		{name: "configured", configured: "agent-1", want: "agent-1"},
+		{name: "hostname", configured: "", want: hostname},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := ResolveInstanceID(tt.configured)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, id)
+		})
+	}
+}
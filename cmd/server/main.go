@@ -5,10 +5,14 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	"crypto/rsa"
+	"crypto/tls"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
@@ -18,29 +22,44 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/auth"
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/config"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/encryption"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/events"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/grpcserver"
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/handlers"
-	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/middleware"
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/storage"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/tlsconfig"
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
-var host, storeFile, restore, key, connStr, storeParameter, buildVersion, buildDate, buildCommit *string
-var storeInterval string
-var db *sql.DB
+var host, grpcHost, cryptoKey, tlsCert, tlsKey, tlsClientCA, trustedSubnet, adminToken, tokensFile, storeFile, restore, key, connStr, storeParameter, migrateOnly, migrateDryRun, migrateTimeout, history, staleTTL, staleRemove, buildVersion, buildDate, buildCommit *string
 
 func init() {
 
-	metrics.Container = make(map[string]interface{})
-
 	host = config.GetEnv("ADDRESS", flag.String("a", "127.0.0.1:8080", "ADDRESS"))
+	grpcHost = config.GetEnv("GRPC_ADDRESS", flag.String("g", "", "GRPC_ADDRESS"))
 	key = config.GetEnv("KEY", flag.String("k", "", "KEY"))
+	cryptoKey = config.GetEnv("CRYPTO_KEY", flag.String("crypto-key", "", "CRYPTO_KEY"))
+	tlsCert = config.GetEnv("TLS_CERT", flag.String("tls-cert", "", "TLS_CERT"))
+	tlsKey = config.GetEnv("TLS_KEY", flag.String("tls-key", "", "TLS_KEY"))
+	tlsClientCA = config.GetEnv("TLS_CLIENT_CA", flag.String("tls-client-ca", "", "TLS_CLIENT_CA"))
+	trustedSubnet = config.GetEnv("TRUSTED_SUBNET", flag.String("t", "", "TRUSTED_SUBNET"))
+	adminToken = config.GetEnv("ADMIN_TOKEN", flag.String("admin-token", "", "ADMIN_TOKEN"))
+	tokensFile = config.GetEnv("TOKENS_FILE", flag.String("tokens-file", "", "TOKENS_FILE"))
 	storeParameter = config.GetEnv("STORE_INTERVAL", flag.String("i", "300", "STORE_INTERVAL"))
 	storeFile = config.GetEnv("STORE_FILE", flag.String("f", "/tmp/devops-metrics-db.json", "STORE_FILE"))
 	restore = config.GetEnv("RESTORE", flag.String("r", "true", "RESTORE"))
 	connStr = config.GetEnv("DATABASE_DSN", flag.String("d", "", "DATABASE_DSN"))
+	history = config.GetEnv("HISTORY", flag.String("history", "false", "HISTORY"))
+	staleTTL = config.GetEnv("STALE_TTL", flag.String("stale-ttl", "0", "STALE_TTL"))
+	staleRemove = config.GetEnv("STALE_REMOVE", flag.String("stale-remove", "false", "STALE_REMOVE"))
+	migrateOnly = config.GetEnv("MIGRATE_ONLY", flag.String("migrate-only", "false", "MIGRATE_ONLY"))
+	migrateDryRun = config.GetEnv("MIGRATE_DRY_RUN", flag.String("migrate-dry-run", "false", "MIGRATE_DRY_RUN"))
+	migrateTimeout = config.GetEnv("MIGRATE_TIMEOUT", flag.String("migrate-timeout", "0", "MIGRATE_TIMEOUT"))
 	buildVersion = config.GetEnv("BUILD_VERSION", flag.String("bv", "N/A", "BUILD_VERSION"))
 	buildDate = config.GetEnv("BUILD_DATE", flag.String("bd", "N/A", "BUILD_DATE"))
 	buildCommit = config.GetEnv("BUILD_COMMIT", flag.String("bc", "N/A", "BUILD_COMMIT"))
@@ -50,43 +69,131 @@ func init() {
 
 }
 
+// privateKey decrypts the request bodies encrypted by the agents, nil disables the decryption.
+var privateKey *rsa.PrivateKey
+
+// trusted is the subnet of the agents allowed to update the metrics, nil accepts the updates from any address.
+var trusted *net.IPNet
+
+// tokenStore keeps the issued bearer tokens and authenticator checks them, nil values leave the endpoints open.
+var tokenStore auth.Store
+var authenticator *auth.Authenticator
+
+// broker publishes the accepted updates to the event streams of the router.
+var broker = events.NewBroker()
+
+// activity keeps the last update of every metric received over HTTP and gRPC.
+var activity = events.NewActivity()
+
 // InitializeRouter function returns Gorilla mux router with the endpoints that allow reception / retrieval of system metrics.
-func InitializeRouter() *mux.Router {
+func InitializeRouter(st storage.Storage) *mux.Router {
 
 	r := mux.NewRouter()
 
-	handlersWithKey := handlers.NewWrapperJSONStruct()
-	r.HandleFunc("/update/", handlersWithKey.UpdateJSONHandler)
-	r.HandleFunc("/value/", handlersWithKey.ValueJSONHandler)
-	r.HandleFunc("/update/{type}/{name}/{value}", handlersWithKey.UpdateStringHandler)
-	r.HandleFunc("/value/{type}/{name}", handlersWithKey.ValueStringHandler)
+	handlersWithKey := handlers.NewWrapperJSONStruct(st, config.Key).WithStaleTTL(config.StaleTTL).WithActivity(activity).WithBroker(broker).WithTokens(tokenStore)
+	// with the token store configured the endpoints require a bearer token granting their scope
+	scoped := func(scope string, h http.Handler) http.Handler {
+		if authenticator == nil {
+			return h
+		}
+		return middleware.AuthHandler(authenticator, scope)(h)
+	}
+	read := func(h http.HandlerFunc) http.Handler { return scoped(auth.ScopeRead, h) }
+	admin := func(h http.HandlerFunc) http.Handler { return scoped(auth.ScopeAdmin, h) }
+	// the endpoints changing the stored metrics accept only the agents from the trusted subnet
+	update := func(h http.HandlerFunc) http.Handler {
+		if trusted != nil {
+			return scoped(auth.ScopeWrite, middleware.TrustedSubnetHandler(trusted)(h))
+		}
+		return scoped(auth.ScopeWrite, h)
+	}
+	r.Handle("/update/", update(handlersWithKey.UpdateJSONHandler))
+	r.Handle("/value/", read(handlersWithKey.ValueJSONHandler))
+	r.Handle("/update/{type}/{name}/{value}", update(handlersWithKey.UpdateStringHandler))
+	r.Handle("/value/{type}/{name}", update(handlersWithKey.DeleteHandler)).Methods(http.MethodDelete)
+	r.Handle("/value/{type}/{name}", read(handlersWithKey.ValueStringHandler))
 	r.HandleFunc("/ping", handlersWithKey.PostgresHandler)
-	r.HandleFunc("/updates/", handlersWithKey.UpdateBatchJSONHandler)
+	batch := http.Handler(http.HandlerFunc(handlersWithKey.UpdateBatchJSONHandler))
+	if config.Key != "" {
+		// the batch is signed as a whole, the hashes of its metrics are not checked
+		batch = middleware.HashHandler(config.Key)(batch)
+	}
+	r.Handle("/updates/", update(batch.ServeHTTP))
+	r.Handle("/deletes/", update(handlersWithKey.DeleteBatchJSONHandler))
+	r.Handle("/reset/{type}/{name}", update(handlersWithKey.ResetHandler))
+	r.Handle("/history/{type}/{name}", read(handlersWithKey.HistoryHandler))
+	r.Handle("/metrics", read(handlersWithKey.PrometheusHandler))
+	r.Handle("/api/v1/metrics", read(handlersWithKey.ListHandler))
+	r.Handle("/api/v1/agents", read(handlersWithKey.AgentsHandler))
+	r.Handle("/api/v1/stream", read(handlersWithKey.StreamHandler))
+	if tokenStore != nil {
+		r.Handle("/api/v1/tokens", admin(handlersWithKey.ListTokensHandler)).Methods(http.MethodGet)
+		r.Handle("/api/v1/tokens", admin(handlersWithKey.CreateTokenHandler)).Methods(http.MethodPost)
+		r.Handle("/api/v1/tokens/{id}", admin(handlersWithKey.RevokeTokenHandler)).Methods(http.MethodDelete)
+	}
 
-	r.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
-	r.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
-	r.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
-	r.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
-	r.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
-	r.Handle("/debug/pprof/{cmd}", http.HandlerFunc(pprof.Index)) // special handling for Gorilla mux
+	r.Handle("/debug/pprof/", admin(pprof.Index))
+	r.Handle("/debug/pprof/cmdline", admin(pprof.Cmdline))
+	r.Handle("/debug/pprof/profile", admin(pprof.Profile))
+	r.Handle("/debug/pprof/symbol", admin(pprof.Symbol))
+	r.Handle("/debug/pprof/trace", admin(pprof.Trace))
+	r.Handle("/debug/pprof/{cmd}", admin(pprof.Index)) // special handling for Gorilla mux
 
-	r.HandleFunc("/", handlersWithKey.GenericHandler)
+	r.Handle("/", read(handlersWithKey.GenericHandler))
+	if privateKey != nil {
+		r.Use(middleware.DecryptHandler(privateKey))
+	}
 	r.Use(middleware.GzipHandler)
 	return r
 }
 
-// ParseStoreInterval function does the procesing of storeinterval input variable. 
-func ParseStoreInterval(storeParameter *string) int {
+// ParseStoreInterval function does the procesing of storeinterval input variable.
+// Zero interval enables the synchronous saving of the received system metrics.
+func ParseStoreInterval(storeParameter *string) time.Duration {
+
+	storeInterval, err := config.ParseDuration(*storeParameter)
+	if err != nil || storeInterval < 0 {
+		log.Fatalf("Error happened in reading storeInterval variable %q. Err: %v", *storeParameter, err)
+	}
+	return storeInterval
+}
+
+// ParseStaleTTL function does the procesing of the stale ttl input variable. Zero ttl disables the stale gauges detection.
+func ParseStaleTTL(staleTTL *string) time.Duration {
+
+	ttl, err := config.ParseDuration(*staleTTL)
+	if err != nil || ttl < 0 {
+		log.Fatalf("Error happened in reading staleTTL variable %q. Err: %v", *staleTTL, err)
+	}
+	return ttl
+}
+
+// ParseTrustedSubnet function does the procesing of the trusted subnet input variable in CIDR notation.
+// Empty value disables the check of the agents address.
+func ParseTrustedSubnet(trustedSubnet *string) *net.IPNet {
 
-	storeInterval = strings.Replace(strings.Replace(*storeParameter, "s", "", -1), "m", "", -1)
-	storeInt, err := strconv.Atoi(storeInterval)
+	if *trustedSubnet == "" {
+		return nil
+	}
+	_, subnet, err := net.ParseCIDR(*trustedSubnet)
 	if err != nil {
-		log.Fatalf("Error happened in reading storeInt variable. Err: %s", err)
+		log.Fatalf("Error happened in reading trustedSubnet variable %q. Err: %v", *trustedSubnet, err)
+	}
+	return subnet
+}
+
+// ParseMigrateTimeout function does the procesing of the migration timeout input variable.
+// Zero timeout lets the migrations run without a deadline.
+func ParseMigrateTimeout(migrateTimeout *string) time.Duration {
+
+	timeout, err := config.ParseDuration(*migrateTimeout)
+	if err != nil || timeout < 0 {
+		log.Fatalf("Error happened in reading migrateTimeout variable %q. Err: %v", *migrateTimeout, err)
 	}
-	return storeInt
+	return timeout
 }
 
-// ParseRestoreValue function does the procesing of restore input variable. 
+// ParseRestoreValue function does the procesing of restore input variable.
 func ParseRestoreValue(restore *string) bool {
 
 	restoreValue, err := strconv.ParseBool(*restore)
@@ -96,8 +203,58 @@ func ParseRestoreValue(restore *string) bool {
 	return restoreValue
 }
 
+// ParseBoolValue function does the procesing of boolean input variables.
+func ParseBoolValue(name string, value *string) bool {
+
+	boolValue, err := strconv.ParseBool(*value)
+	if err != nil {
+		log.Fatalf("Error happened in reading %s variable. Err: %s", name, err)
+	}
+	return boolValue
+}
+
+// PrintMigrations function writes the SQL of the pending schema migrations for the dry-run mode.
+func PrintMigrations(w io.Writer, migrations []storage.Migration) {
+
+	if len(migrations) == 0 {
+		fmt.Fprintln(w, "-- no pending migrations")
+		return
+	}
+	for _, m := range migrations {
+		fmt.Fprintf(w, "-- migration %04d_%s\n%s\n", m.Version, m.Name, strings.TrimSpace(m.SQL))
+	}
+}
+
+// Keygen function generates the RSA key pair for the payload encryption and writes it to PEM files.
+// It is run with the keygen subcommand: server keygen [-bits 4096] [-private private.pem] [-public public.pem].
+// The private key is passed to the server and the public key to the agents with the -crypto-key flag.
+func Keygen(args []string, w io.Writer) error {
+
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	fs.SetOutput(w)
+	bits := fs.Int("bits", encryption.DefaultKeyBits, "RSA key size")
+	privatePath := fs.String("private", "private.pem", "private key file")
+	publicPath := fs.String("public", "public.pem", "public key file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	privPEM, pubPEM, err := encryption.GenerateKeys(*bits)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(*privatePath, privPEM, 0600); err != nil {
+		return err
+	}
+	if err = os.WriteFile(*publicPath, pubPEM, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Private key written to %s\nPublic key written to %s\n", *privatePath, *publicPath)
+	return nil
+}
+
 // ShutdownGracefully handles server shutdown and information saving.
-func ShutdownGracefully(srv *http.Server, storeFile *string, connStr *string) {
+func ShutdownGracefully(srv *http.Server, st storage.Storage) {
 
 	shutdownCtx, shutdownRelease := context.WithTimeout(context.Background(), config.ContextSrvTimeout*time.Second)
 	defer shutdownRelease()
@@ -107,8 +264,8 @@ func ShutdownGracefully(srv *http.Server, storeFile *string, connStr *string) {
 	}
 	log.Println("Graceful shutdown complete.")
 
-	if len(*storeFile) > 0 && len(*connStr) == 0 {
-		storage.StaticFileSave(*storeFile)
+	if err := st.Close(); err != nil {
+		log.Printf("Error happened when closing the storage. Err: %s", err)
 	}
 }
 
@@ -116,61 +273,176 @@ func main() {
 
 	flag.Parse()
 
+	if flag.Arg(0) == "keygen" {
+		if err := Keygen(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("Error happened in generating keys. Err: %s", err)
+		}
+		return
+	}
+
+	if len(*cryptoKey) > 0 {
+		var err error
+		if privateKey, err = encryption.ReadPrivateKey(*cryptoKey); err != nil {
+			log.Fatalf("Error happened in reading crypto key %s. Err: %s", *cryptoKey, err)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if len(*tlsCert) > 0 || len(*tlsKey) > 0 || len(*tlsClientCA) > 0 {
+		var err error
+		if tlsConfig, err = tlsconfig.ServerConfig(*tlsCert, *tlsKey, *tlsClientCA); err != nil {
+			log.Fatalf("Error happened in reading TLS configuration. Err: %s", err)
+		}
+	}
+
 	restoreValue := ParseRestoreValue(restore)
 
-	storeInt := ParseStoreInterval(storeParameter)
+	storeInterval := ParseStoreInterval(storeParameter)
 
 	config.Key = *key
+	config.StaleTTL = ParseStaleTTL(staleTTL)
+	trusted = ParseTrustedSubnet(trustedSubnet)
 
+	var st storage.Storage
 	if len(*connStr) > 0 {
 		log.Println("Start db connection.")
 		ctx, cancel := context.WithTimeout(context.Background(), config.ContextDBTimeout*time.Second)
 		// не забываем освободить ресурс
 		defer cancel()
-		var err error
-		db, err = sql.Open("postgres", *connStr)
+		if ParseBoolValue("migrateDryRun", migrateDryRun) {
+			pending, err := storage.DBPendingMigrations(ctx, *connStr)
+			if err != nil {
+				log.Fatalf("Error happened when reading pending migrations. Err: %s", err)
+			}
+			PrintMigrations(os.Stdout, pending)
+			return
+		}
+		// migrations rewriting large tables take longer than the queries, they get their own deadline
+		migrateCtx := context.Background()
+		if timeout := ParseMigrateTimeout(migrateTimeout); timeout > 0 {
+			var migrateCancel context.CancelFunc
+			migrateCtx, migrateCancel = context.WithTimeout(migrateCtx, timeout)
+			defer migrateCancel()
+		}
+		ds, err := storage.NewDBStorage(migrateCtx, *connStr)
 		if err != nil {
 			log.Fatalf("Error happened when initiating connection to the db. Err: %s", err)
 		}
-		_, err = db.ExecContext(ctx,
-			"CREATE TABLE IF NOT EXISTS metrics (metrics_id int GENERATED ALWAYS AS IDENTITY PRIMARY KEY, name text NOT NULL, delta bigint, value double precision)")
-		if err != nil {
-			log.Fatalf("Error happened when creating sql table. Err: %s", err)
-
+		if ParseBoolValue("migrateOnly", migrateOnly) {
+			ds.Close()
+			log.Println("Migrations applied.")
+			return
 		}
+		st = ds
 
-		config.DB = db
-		config.DBFlag = true
-		defer db.Close()
+	} else if len(*storeFile) > 0 {
+		fs := storage.NewFileStorage(*storeFile)
+		if restoreValue {
+			if err := fs.Restore(); err != nil {
+				log.Fatalf("Error happened when restoring metrics from %s, fix or remove the file to start. Err: %s", *storeFile, err)
+			}
+		}
+		if storeInterval == 0 {
+			fs.EnableSyncSave()
+		}
+		go storage.ContainerUpdate(storeInterval, fs)
+		st = fs
 
 	} else {
-		if len(*storeFile) > 0 {
-			if restoreValue {
-				storage.StaticFileUpload(*storeFile)
+		st = storage.NewMemStorage()
+	}
+
+	if ParseBoolValue("history", history) {
+		hs, ok := st.(storage.HistoryStorage)
+		if !ok {
+			log.Fatalf("Error happened in enabling history mode. Err: %s", storage.ErrHistoryDisabled)
+		}
+		hs.EnableHistory()
+	}
+
+	if ParseBoolValue("staleRemove", staleRemove) {
+		go storage.ExpireUpdate(config.StaleTTL, st, activity.Expire)
+	}
+
+	if len(*adminToken) > 0 {
+		if ds, ok := st.(*storage.DBStorage); ok {
+			tokenStore = ds.TokenStore()
+		} else {
+			// the tokens grant access to the server, so they are not kept at a default location shared with other users
+			if len(*tokensFile) == 0 {
+				log.Fatalf("TOKENS_FILE is required with ADMIN_TOKEN when DATABASE_DSN is not set")
 			}
-			go storage.ContainerUpdate(storeInt, *storeFile, db, *storeParameter)
+			fs, err := auth.NewFileStore(*tokensFile)
+			if err != nil {
+				log.Fatalf("Error happened when loading tokens from %s. Err: %s", *tokensFile, err)
+			}
+			tokenStore = fs
 		}
-		config.DBFlag = false
+		authenticator = auth.NewAuthenticator(tokenStore, *adminToken)
 	}
 
-	r := InitializeRouter()
+	r := InitializeRouter(st)
 
 	srv := &http.Server{
-		Handler: r,
-		Addr:    *host,
+		Handler:   r,
+		Addr:      *host,
+		TLSConfig: tlsConfig,
 	}
+	// the open event streams are closed on shutdown, so they do not delay it
+	srv.RegisterOnShutdown(broker.Close)
 
 	go func() {
-		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if srv.TLSConfig != nil {
+			// the certificate is already loaded into the TLS configuration
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("HTTP server error: %v", err)
 		}
 		log.Println("Stopped serving new connections.")
 	}()
 
+	var grpcSrv *grpc.Server
+	if len(*grpcHost) > 0 {
+		listen, err := net.Listen("tcp", *grpcHost)
+		if err != nil {
+			log.Fatalf("Error happened when starting gRPC listener. Err: %s", err)
+		}
+		var opts []grpc.ServerOption
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		var unary []grpc.UnaryServerInterceptor
+		var stream []grpc.StreamServerInterceptor
+		if authenticator != nil {
+			unary = append(unary, grpcserver.AuthUnaryInterceptor(authenticator))
+			stream = append(stream, grpcserver.AuthStreamInterceptor(authenticator))
+		}
+		if trusted != nil {
+			unary = append(unary, grpcserver.TrustedSubnetUnaryInterceptor(trusted))
+			stream = append(stream, grpcserver.TrustedSubnetStreamInterceptor(trusted))
+		}
+		opts = append(opts, grpc.ChainUnaryInterceptor(unary...), grpc.ChainStreamInterceptor(stream...))
+		ms := grpcserver.NewMetricsServer(st, config.Key, config.StaleTTL).WithActivity(activity).WithBroker(broker)
+		grpcSrv = grpcserver.NewServer(ms, opts...)
+		go func() {
+			if err := grpcSrv.Serve(listen); err != nil {
+				log.Fatalf("gRPC server error: %v", err)
+			}
+			log.Println("Stopped serving new gRPC connections.")
+		}()
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
 	<-sigChan
 
-	ShutdownGracefully(srv, storeFile, connStr)
+	if grpcSrv != nil {
+		grpcSrv.GracefulStop()
+	}
+	ShutdownGracefully(srv, st)
 
 }
@@ -2,16 +2,27 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"testing"
-	"log"
+	"time"
 
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/auth"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/config"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/encryption"
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/handlers"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/httpp"
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/middleware"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/storage"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/tlsconfig"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/tlsconfig/tlstest"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -39,7 +50,7 @@ func TestRouter(t *testing.T) {
 
 	r := mux.NewRouter()
 
-	handlersWithKey := handlers.NewWrapperJSONStruct()
+	handlersWithKey := handlers.NewWrapperJSONStruct(storage.NewMemStorage(), "")
 
 	r.HandleFunc("/update/", handlersWithKey.UpdateJSONHandler)
 	r.HandleFunc("/value/", handlersWithKey.ValueJSONHandler)
@@ -88,7 +99,7 @@ func TestInitializeRouter(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			InitializeRouter()
+			InitializeRouter(storage.NewMemStorage())
 
 		})
 	}
@@ -99,12 +110,32 @@ func TestParseStoreInterval(t *testing.T) {
 	tests := []struct {
 		name           string
 		storeParameter string
-		want           int
+		want           time.Duration
 	}{
 		{
 			name:           "trial run",
 			storeParameter: "3m",
-			want:           3,
+			want:           3 * time.Minute,
+		},
+		{
+			name:           "seconds without unit",
+			storeParameter: "300",
+			want:           300 * time.Second,
+		},
+		{
+			name:           "composite duration",
+			storeParameter: "1m30s",
+			want:           90 * time.Second,
+		},
+		{
+			name:           "milliseconds",
+			storeParameter: "500ms",
+			want:           500 * time.Millisecond,
+		},
+		{
+			name:           "synchronous saving",
+			storeParameter: "0",
+			want:           0,
 		},
 	}
 	for _, tt := range tests {
@@ -115,6 +146,24 @@ func TestParseStoreInterval(t *testing.T) {
 	}
 }
 
+func TestParseMigrateTimeout(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		migrateTimeout string
+		want           time.Duration
+	}{
+		{name: "no deadline", migrateTimeout: "0", want: 0},
+		{name: "seconds without unit", migrateTimeout: "600", want: 10 * time.Minute},
+		{name: "duration", migrateTimeout: "2h", want: 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ParseMigrateTimeout(&tt.migrateTimeout))
+		})
+	}
+}
+
 func TestParseRestoreValue(t *testing.T) {
 
 	tests := []struct {
@@ -136,31 +185,306 @@ func TestParseRestoreValue(t *testing.T) {
 	}
 }
 
+func TestPrintMigrations(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		migrations []storage.Migration
+		want       string
+	}{
+		{
+			name:       "no pending migrations",
+			migrations: nil,
+			want:       "-- no pending migrations\n",
+		},
+		{
+			name:       "pending migration",
+			migrations: []storage.Migration{{Version: 3, Name: "add_index", SQL: "CREATE INDEX metrics_type ON metrics (type);\n"}},
+			want:       "-- migration 0003_add_index\nCREATE INDEX metrics_type ON metrics (type);\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			PrintMigrations(&buf, tt.migrations)
+			assert.Equal(t, tt.want, buf.String())
+		})
+	}
+}
+
+func TestKeygenEncryptedBatch(t *testing.T) {
+
+	dir := t.TempDir()
+	var out bytes.Buffer
+	require.NoError(t, Keygen([]string{"-bits", "2048", "-private", filepath.Join(dir, "private.pem"), "-public", filepath.Join(dir, "public.pem")}, &out))
+	assert.Contains(t, out.String(), "public.pem")
+
+	priv, err := encryption.ReadPrivateKey(filepath.Join(dir, "private.pem"))
+	require.NoError(t, err)
+	pub, err := encryption.ReadPublicKey(filepath.Join(dir, "public.pem"))
+	require.NoError(t, err)
+
+	privateKey = priv
+	defer func() { privateKey = nil }()
+	st := storage.NewMemStorage()
+	ts := httptest.NewServer(InitializeRouter(st))
+	defer ts.Close()
+
+	value := 2.5
+	body, err := json.Marshal([]metrics.Metrics{{ID: "Alloc", MType: metrics.Gauge, Value: &value}})
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(body)
+	require.NoError(t, gz.Close())
+	message, err := encryption.Encrypt(pub, buf.Bytes())
+	require.NoError(t, err)
+
+	post := func(message []byte) int {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates/", bytes.NewReader(message))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set(encryption.Header, encryption.Scheme)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusBadRequest, post(buf.Bytes()))
+	assert.Equal(t, http.StatusOK, post(message))
+
+	mp, err := st.Get(context.Background(), metrics.Metrics{ID: "Alloc", MType: metrics.Gauge})
+	require.NoError(t, err)
+	assert.Equal(t, value, *mp.Value)
+}
+
+func TestMutualTLS(t *testing.T) {
+
+	files := tlstest.NewFiles(t)
+	serverConfig, err := tlsconfig.ServerConfig(files.ServerCert, files.ServerKey, files.CA)
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(InitializeRouter(storage.NewMemStorage()))
+	ts.TLS = serverConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		certFile   string
+		keyFile    string
+		wantStatus int
+	}{
+		{name: "known agent", certFile: files.ClientCert, keyFile: files.ClientKey, wantStatus: http.StatusOK},
+		{name: "no client certificate"},
+		{name: "server certificate is not a client one", certFile: files.ServerCert, keyFile: files.ServerKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConfig, err := tlsconfig.ClientConfig(files.CA, tt.certFile, tt.keyFile)
+			require.NoError(t, err)
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+			defer client.CloseIdleConnections()
+
+			resp, err := client.Post(ts.URL+"/update/gauge/Alloc/1.5", "text/plain", nil)
+			if tt.wantStatus == 0 {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestTrustedSubnet(t *testing.T) {
+
+	subnet := "192.168.1.0/24"
+	trusted = ParseTrustedSubnet(&subnet)
+	defer func() { trusted = nil }()
+	ts := httptest.NewServer(InitializeRouter(storage.NewMemStorage()))
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		realIP     string
+		wantStatus int
+	}{
+		{name: "trusted update", method: http.MethodPost, path: "/update/gauge/Alloc/1.5", realIP: "192.168.1.10", wantStatus: http.StatusOK},
+		{name: "update outside subnet", method: http.MethodPost, path: "/update/gauge/Alloc/2.5", realIP: "10.0.0.1", wantStatus: http.StatusForbidden},
+		{name: "update without address", method: http.MethodPost, path: "/updates/", wantStatus: http.StatusForbidden},
+		{name: "invalid address", method: http.MethodDelete, path: "/value/gauge/Alloc", realIP: "192.168.1", wantStatus: http.StatusForbidden},
+		{name: "value is readable from anywhere", method: http.MethodGet, path: "/value/gauge/Alloc", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+			require.NoError(t, err)
+			if tt.realIP != "" {
+				req.Header.Set(middleware.RealIPHeader, tt.realIP)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.method == http.MethodGet {
+				assert.Equal(t, "1.5", string(body))
+			}
+		})
+	}
+}
+
+func TestSignedBatch(t *testing.T) {
+
+	config.Key = "secret"
+	defer func() { config.Key = "" }()
+	ts := httptest.NewServer(InitializeRouter(storage.NewMemStorage()))
+	defer ts.Close()
+
+	value := 0.1 + 0.2
+	body, err := json.Marshal([]metrics.Metrics{{ID: "Alloc", MType: metrics.Gauge, Value: &value}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		hash       string
+		wantStatus int
+	}{
+		{name: "signed batch", hash: httpp.BodyHash(body, config.Key), wantStatus: http.StatusOK},
+		{name: "wrong key", hash: httpp.BodyHash(body, "other"), wantStatus: http.StatusBadRequest},
+		{name: "unsigned batch", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates/", bytes.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			if tt.hash != "" {
+				req.Header.Set(middleware.HashHeader, tt.hash)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			respBody, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, httpp.BodyHash(respBody, config.Key), resp.Header.Get(middleware.HashHeader))
+			}
+		})
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+
+	store, err := auth.NewFileStore(filepath.Join(t.TempDir(), "tokens.json"))
+	require.NoError(t, err)
+	tokenStore, authenticator = store, auth.NewAuthenticator(store, "root")
+	defer func() { tokenStore, authenticator = nil, nil }()
+	ts := httptest.NewServer(InitializeRouter(storage.NewMemStorage()))
+	defer ts.Close()
+
+	do := func(method, path, secret string, body []byte) (int, []byte) {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		require.NoError(t, err)
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, respBody
+	}
+	issue := func(name, instance string, scopes ...string) handlers.TokenInfo {
+		body, err := json.Marshal(handlers.TokenRequest{Name: name, Scopes: scopes, Instance: instance})
+		require.NoError(t, err)
+		status, respBody := do(http.MethodPost, "/api/v1/tokens", "root", body)
+		require.Equal(t, http.StatusCreated, status)
+		var info handlers.TokenInfo
+		require.NoError(t, json.Unmarshal(respBody, &info))
+		require.NotEmpty(t, info.Token)
+		return info
+	}
+	agent := issue("agent-1", "", auth.ScopeWrite)
+	dashboard := issue("dashboard", "", auth.ScopeRead)
+	bound := issue("agent-2", "agent-2", auth.ScopeWrite)
+	require.Equal(t, "agent-2", bound.Instance)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		secret     string
+		wantStatus int
+	}{
+		{name: "update without token", method: http.MethodPost, path: "/update/gauge/Alloc/1.5", wantStatus: http.StatusUnauthorized},
+		{name: "update with unknown token", method: http.MethodPost, path: "/update/gauge/Alloc/1.5", secret: "guess", wantStatus: http.StatusUnauthorized},
+		{name: "update with read token", method: http.MethodPost, path: "/update/gauge/Alloc/1.5", secret: dashboard.Token, wantStatus: http.StatusForbidden},
+		{name: "update with write token", method: http.MethodPost, path: "/update/gauge/Alloc/1.5", secret: agent.Token, wantStatus: http.StatusOK},
+		{name: "update of own instance", method: http.MethodPost, path: "/update/gauge/Alloc/1.5?label=instance=agent-2", secret: bound.Token, wantStatus: http.StatusOK},
+		{name: "update of other instance", method: http.MethodPost, path: "/update/gauge/Alloc/1.5?label=instance=agent-1", secret: bound.Token, wantStatus: http.StatusForbidden},
+		{name: "update without instance", method: http.MethodPost, path: "/update/gauge/Alloc/1.5", secret: bound.Token, wantStatus: http.StatusForbidden},
+		{name: "value with write token", method: http.MethodGet, path: "/value/gauge/Alloc", secret: agent.Token, wantStatus: http.StatusForbidden},
+		{name: "value with read token", method: http.MethodGet, path: "/value/gauge/Alloc", secret: dashboard.Token, wantStatus: http.StatusOK},
+		{name: "debug with read token", method: http.MethodGet, path: "/debug/pprof/", secret: dashboard.Token, wantStatus: http.StatusForbidden},
+		{name: "debug with admin token", method: http.MethodGet, path: "/debug/pprof/", secret: "root", wantStatus: http.StatusOK},
+		{name: "tokens with write token", method: http.MethodGet, path: "/api/v1/tokens", secret: agent.Token, wantStatus: http.StatusForbidden},
+		{name: "ping is open", method: http.MethodGet, path: "/ping", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _ := do(tt.method, tt.path, tt.secret, nil)
+			assert.Equal(t, tt.wantStatus, status)
+		})
+	}
+
+	status, body := do(http.MethodGet, "/api/v1/tokens", "root", nil)
+	require.Equal(t, http.StatusOK, status)
+	var infos []handlers.TokenInfo
+	require.NoError(t, json.Unmarshal(body, &infos))
+	require.Len(t, infos, 3)
+	assert.Empty(t, infos[0].Token)
+	assert.NotContains(t, string(body), "hash")
+
+	status, _ = do(http.MethodDelete, "/api/v1/tokens/"+agent.ID, "root", nil)
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = do(http.MethodPost, "/update/gauge/Alloc/2.5", agent.Token, nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = do(http.MethodDelete, "/api/v1/tokens/"+agent.ID, "root", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = do(http.MethodPost, "/api/v1/tokens", "root", []byte(`{"name":"x","scopes":["delete"]}`))
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
 func TestShutdownGracefully(t *testing.T) {
 
 	tests := []struct {
-		name      string
-		srv       *http.Server
-		storeFile string
-		connStr   string
+		name string
+		srv  *http.Server
+		st   storage.Storage
 	}{
 		{
-			name:      "trial run",
-			storeFile: "/tmp/devops-metrics-db.json",
-			connStr:   "",
+			name: "trial run",
+			st:   storage.NewFileStorage(filepath.Join(t.TempDir(), "devops-metrics-db.json")),
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			tt.srv = &http.Server{}
-			ShutdownGracefully(tt.srv, storeFile, connStr)
+			ShutdownGracefully(tt.srv, tt.st)
 		})
 	}
 }
 
 func ExampleInitializeRouter() {
 
-	r := InitializeRouter()
+	r := InitializeRouter(storage.NewMemStorage())
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 	floatValue := 2.0
@@ -191,4 +515,4 @@ func ExampleInitializeRouter() {
 	defer resp.Body.Close()
 	log.Print(respBody)
 
-}
\ No newline at end of file
+}
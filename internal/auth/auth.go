@@ -0,0 +1,200 @@
+// Auth package contains the bearer tokens granting the agents and the users access to the server endpoints.
+//
+// Available at https://github.com/SiberianMonster/go-musthave-devops-tpl/internal/auth
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Scopes granted to the tokens. The admin scope grants all the others.
+const (
+	// ScopeRead allows reading the stored metrics.
+	ScopeRead = "read"
+	// ScopeWrite allows updating, resetting and deleting the metrics.
+	ScopeWrite = "write"
+	// ScopeAdmin allows managing the tokens and using the debug endpoints.
+	ScopeAdmin = "admin"
+)
+
+// AdminTokenID identifies the static admin token configured on the server start.
+const AdminTokenID = "admin"
+
+// ErrTokenNotFound is returned when the token is not in the store.
+var ErrTokenNotFound = errors.New("token not found")
+
+// ErrUnauthorized is returned when the request has no token or the token is unknown.
+var ErrUnauthorized = errors.New("missing or unknown token")
+
+// ErrForbidden is returned when the token does not grant the scope required by the endpoint.
+var ErrForbidden = errors.New("token scope is not sufficient")
+
+// ErrWrongInstance is returned when the token issued to an agent instance is used to write the metrics of another instance.
+var ErrWrongInstance = errors.New("token is issued to another agent instance")
+
+// tokenKey is the context key of the token the request is authorized with.
+type tokenKey struct{}
+
+// Token struct describes the issued token. The secret itself is not kept, only its hash.
+// The token with the Instance set writes only the metrics labeled with that agent instance.
+type Token struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Scopes   []string  `json:"scopes"`
+	Instance string    `json:"instance,omitempty"`
+	Hash     string    `json:"hash,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// Allows function reports whether the token grants the scope.
+func (t Token) Allows(scope string) bool {
+
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// NewContext function returns a copy of the context carrying the token the request is authorized with.
+func NewContext(ctx context.Context, t Token) context.Context {
+
+	return context.WithValue(ctx, tokenKey{}, t)
+}
+
+// FromContext function returns the token the request is authorized with.
+func FromContext(ctx context.Context) (Token, bool) {
+
+	t, ok := ctx.Value(tokenKey{}).(Token)
+	return t, ok
+}
+
+// CheckInstance function returns ErrWrongInstance when the request is authorized with a token
+// issued to an agent instance other than the one the written metric is labeled with.
+// The requests without a token and the tokens without an instance write the metrics of any instance.
+func CheckInstance(ctx context.Context, instance string) error {
+
+	t, ok := FromContext(ctx)
+	if !ok || t.Instance == "" || t.Instance == instance {
+		return nil
+	}
+	return ErrWrongInstance
+}
+
+// Store interface describes the storage of the issued tokens.
+type Store interface {
+	// Create function saves the new token.
+	Create(ctx context.Context, t Token) error
+	// Lookup function returns the token with the secret hash or ErrTokenNotFound.
+	Lookup(ctx context.Context, hash string) (Token, error)
+	// Revoke function removes the token by its ID or returns ErrTokenNotFound.
+	Revoke(ctx context.Context, id string) error
+	// List function returns all the tokens ordered by the creation time.
+	List(ctx context.Context) ([]Token, error)
+}
+
+// ValidScope function checks that the scope is supported.
+func ValidScope(scope string) bool {
+
+	return scope == ScopeRead || scope == ScopeWrite || scope == ScopeAdmin
+}
+
+// NewToken function issues the token with the scopes and returns it together with its secret,
+// which is shown to the caller once and cannot be restored from the store.
+func NewToken(name string, scopes []string) (Token, string, error) {
+
+	if name == "" {
+		return Token{}, "", errors.New("token name is required")
+	}
+	if len(scopes) == 0 {
+		return Token{}, "", errors.New("token scopes are required")
+	}
+	for _, scope := range scopes {
+		if !ValidScope(scope) {
+			return Token{}, "", fmt.Errorf("invalid scope %q", scope)
+		}
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return Token{}, "", err
+	}
+	t := Token{ID: id, Name: name, Scopes: scopes, Hash: HashSecret(secret), Created: time.Now().UTC()}
+	return t, secret, nil
+}
+
+// HashSecret function returns the hash the token is stored and looked up by.
+func HashSecret(secret string) string {
+
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// BearerToken function returns the secret of the Authorization header value with the Bearer scheme.
+func BearerToken(header string) string {
+
+	const prefix = "bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// Authenticator checks the tokens received with the requests against the store and the static admin token.
+type Authenticator struct {
+	store     Store
+	adminHash string
+}
+
+// NewAuthenticator function returns Authenticator object. The admin token grants all the scopes,
+// it is required to issue the first tokens.
+func NewAuthenticator(store Store, adminToken string) *Authenticator {
+
+	return &Authenticator{store: store, adminHash: HashSecret(adminToken)}
+}
+
+// Authorize function returns the token of the secret if it grants the scope.
+// ErrUnauthorized is returned for the missing or unknown secret and ErrForbidden for the insufficient scope.
+func (a *Authenticator) Authorize(ctx context.Context, secret, scope string) (Token, error) {
+
+	if secret == "" {
+		return Token{}, ErrUnauthorized
+	}
+	hash := HashSecret(secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(a.adminHash)) == 1 {
+		return Token{ID: AdminTokenID, Name: AdminTokenID, Scopes: []string{ScopeAdmin}}, nil
+	}
+	t, err := a.store.Lookup(ctx, hash)
+	if errors.Is(err, ErrTokenNotFound) {
+		return Token{}, ErrUnauthorized
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	if !t.Allows(scope) {
+		return t, ErrForbidden
+	}
+	return t, nil
+}
+
+// randomHex function returns n random bytes encoded as hex.
+func randomHex(n int) (string, error) {
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewToken(t *testing.T) {
+
+	token, secret, err := NewToken("agent-1", []string{ScopeWrite})
+	require.NoError(t, err)
+	assert.Equal(t, HashSecret(secret), token.Hash)
+	assert.True(t, token.Allows(ScopeWrite))
+	assert.False(t, token.Allows(ScopeRead))
+
+	_, _, err = NewToken("agent-1", []string{"delete"})
+	assert.Error(t, err)
+	_, _, err = NewToken("", []string{ScopeRead})
+	assert.Error(t, err)
+	_, _, err = NewToken("agent-1", nil)
+	assert.Error(t, err)
+}
+
+func TestBearerToken(t *testing.T) {
+
+	assert.Equal(t, "abc", BearerToken("Bearer abc"))
+	assert.Equal(t, "abc", BearerToken("bearer abc"))
+	assert.Empty(t, BearerToken("Basic abc"))
+	assert.Empty(t, BearerToken(""))
+}
+
+func TestFileStore(t *testing.T) {
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	store, err := NewFileStore(path)
+	require.NoError(t, err)
+
+	first, firstSecret, err := NewToken("agent-1", []string{ScopeWrite})
+	require.NoError(t, err)
+	second, _, err := NewToken("dashboard", []string{ScopeRead})
+	require.NoError(t, err)
+	require.NoError(t, store.Create(ctx, first))
+	require.NoError(t, store.Create(ctx, second))
+
+	// the tokens survive the restart
+	store, err = NewFileStore(path)
+	require.NoError(t, err)
+	got, err := store.Lookup(ctx, HashSecret(firstSecret))
+	require.NoError(t, err)
+	assert.Equal(t, first.ID, got.ID)
+	tokens, err := store.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, tokens, 2)
+
+	require.NoError(t, store.Revoke(ctx, first.ID))
+	assert.ErrorIs(t, store.Revoke(ctx, first.ID), ErrTokenNotFound)
+	store, err = NewFileStore(path)
+	require.NoError(t, err)
+	_, err = store.Lookup(ctx, HashSecret(firstSecret))
+	assert.ErrorIs(t, err, ErrTokenNotFound)
+}
+
+func TestAuthorize(t *testing.T) {
+
+	ctx := context.Background()
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "tokens.json"))
+	require.NoError(t, err)
+	token, secret, err := NewToken("dashboard", []string{ScopeRead})
+	require.NoError(t, err)
+	require.NoError(t, store.Create(ctx, token))
+	a := NewAuthenticator(store, "root")
+
+	tests := []struct {
+		name    string
+		secret  string
+		scope   string
+		wantErr error
+	}{
+		{name: "read token reads", secret: secret, scope: ScopeRead},
+		{name: "read token cannot write", secret: secret, scope: ScopeWrite, wantErr: ErrForbidden},
+		{name: "admin token", secret: "root", scope: ScopeAdmin},
+		{name: "unknown token", secret: "guess", scope: ScopeRead, wantErr: ErrUnauthorized},
+		{name: "missing token", scope: ScopeRead, wantErr: ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := a.Authorize(ctx, tt.secret, tt.scope)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestCheckInstance(t *testing.T) {
+
+	ctx := context.Background()
+	assert.NoError(t, CheckInstance(ctx, "agent-1"))
+	assert.NoError(t, CheckInstance(NewContext(ctx, Token{ID: "a"}), "agent-1"))
+
+	bound := NewContext(ctx, Token{ID: "b", Instance: "agent-1"})
+	assert.NoError(t, CheckInstance(bound, "agent-1"))
+	assert.ErrorIs(t, CheckInstance(bound, "agent-2"), ErrWrongInstance)
+	assert.ErrorIs(t, CheckInstance(bound, ""), ErrWrongInstance)
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FileStore keeps the tokens in memory and saves them to the json-file on every change.
+type FileStore struct {
+	mu     sync.RWMutex
+	path   string
+	tokens map[string]Token
+}
+
+// NewFileStore function returns FileStore object with the tokens loaded from the json-file.
+// A missing file is not an error, it is created with the first token.
+func NewFileStore(path string) (*FileStore, error) {
+
+	fs := &FileStore{path: path, tokens: make(map[string]Token)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return fs, nil
+	}
+	var tokens []Token
+	if err = json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		fs.tokens[t.ID] = t
+	}
+	return fs, nil
+}
+
+// Create function saves the new token.
+func (fs *FileStore) Create(ctx context.Context, t Token) error {
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.tokens[t.ID]; ok {
+		return errors.New("token already exists")
+	}
+	fs.tokens[t.ID] = t
+	if err := fs.save(); err != nil {
+		delete(fs.tokens, t.ID)
+		return err
+	}
+	return nil
+}
+
+// Lookup function returns the token with the secret hash.
+func (fs *FileStore) Lookup(ctx context.Context, hash string) (Token, error) {
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	for _, t := range fs.tokens {
+		if t.Hash == hash {
+			return t, nil
+		}
+	}
+	return Token{}, ErrTokenNotFound
+}
+
+// Revoke function removes the token.
+func (fs *FileStore) Revoke(ctx context.Context, id string) error {
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	t, ok := fs.tokens[id]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	delete(fs.tokens, id)
+	if err := fs.save(); err != nil {
+		fs.tokens[id] = t
+		return err
+	}
+	return nil
+}
+
+// List function returns all the tokens ordered by the creation time.
+func (fs *FileStore) List(ctx context.Context) ([]Token, error) {
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.list(), nil
+}
+
+// list function returns the tokens ordered by the creation time and ID, the caller holds the lock.
+func (fs *FileStore) list() []Token {
+
+	tokens := make([]Token, 0, len(fs.tokens))
+	for _, t := range fs.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].Created.Equal(tokens[j].Created) {
+			return tokens[i].Created.Before(tokens[j].Created)
+		}
+		return tokens[i].ID < tokens[j].ID
+	})
+	return tokens
+}
+
+// save function writes the tokens to a temporary file and renames it over the json-file, the caller holds the lock.
+// The file is readable by the owner only, since it holds the hashes of the secrets.
+func (fs *FileStore) save() error {
+
+	data, err := json.Marshal(fs.list())
+	if err != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", err)
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".tmp-*")
+	if err != nil {
+		log.Printf("Error happened in JSON file opening. Err: %s", err)
+		return err
+	}
+	// the temporary file is left only if saving fails
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Error happened when writing tokens file. Err: %s", err)
+		return err
+	}
+	return os.Rename(file.Name(), fs.path)
+}
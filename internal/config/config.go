@@ -4,8 +4,9 @@
 package config
 
 import (
-	"database/sql"
 	"os"
+	"strconv"
+	"time"
 )
 
 // Database and Server context timeout values.
@@ -16,10 +17,9 @@ const (
 
 // Optional hashing Key.
 var Key string
-// Shared SQL database instance.
-var DB *sql.DB
-// Flag for SQL database use.
-var DBFlag bool
+
+// Optional time after which the gauges that were not updated are reported as stale.
+var StaleTTL time.Duration
 
 // GetEnv function is used for retrieving variables passed in the command prompt.
 func GetEnv(key string, fallback *string) *string {
@@ -28,3 +28,13 @@ func GetEnv(key string, fallback *string) *string {
 	}
 	return fallback
 }
+
+// ParseDuration function parses interval variables in Go duration format, e.g. 500ms or 1m30s.
+// Values without a unit are treated as seconds.
+func ParseDuration(value string) (time.Duration, error) {
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
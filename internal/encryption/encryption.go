@@ -0,0 +1,182 @@
+// Encryption package contains the hybrid RSA and AES-GCM encryption of the request bodies sent by the agent.
+//
+// Every body is sealed with a random AES-256 key in GCM mode, the key is encrypted with the server RSA public key
+// using OAEP with SHA-256. The encrypted body is the encrypted key followed by the GCM nonce and the sealed data.
+//
+// Available at https://github.com/SiberianMonster/go-musthave-devops-tpl/internal/encryption
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Header marks the encrypted request bodies, its value is the encryption scheme.
+const Header = "X-Content-Encryption"
+
+// Scheme is the only supported value of the encryption header.
+const Scheme = "rsa-oaep-aes-gcm"
+
+// DefaultKeyBits is the size of the generated RSA keys.
+const DefaultKeyBits = 4096
+
+// aesKeySize is the size of the AES-256 key generated for every body.
+const aesKeySize = 32
+
+// ErrDecrypt is returned when the encrypted body is malformed or was not encrypted with the matching public key.
+var ErrDecrypt = errors.New("message decryption failed")
+
+// Encrypt function seals the plaintext with a random AES-GCM key encrypted with the RSA public key.
+func Encrypt(pub *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+
+	key := make([]byte, aesKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	message := make([]byte, 0, len(encryptedKey)+len(nonce)+len(plaintext)+gcm.Overhead())
+	message = append(message, encryptedKey...)
+	message = append(message, nonce...)
+	return gcm.Seal(message, nonce, plaintext, nil), nil
+}
+
+// Decrypt function opens the message produced by Encrypt with the RSA private key.
+func Decrypt(priv *rsa.PrivateKey, message []byte) ([]byte, error) {
+
+	keySize := priv.Size()
+	if len(message) < keySize {
+		return nil, fmt.Errorf("%w: message is too short", ErrDecrypt)
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, priv, message[:keySize], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDecrypt, err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDecrypt, err)
+	}
+	rest := message[keySize:]
+	if len(rest) < gcm.NonceSize() {
+		return nil, fmt.Errorf("%w: message is too short", ErrDecrypt)
+	}
+	plaintext, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDecrypt, err)
+	}
+	return plaintext, nil
+}
+
+// newGCM function returns the AES-GCM cipher for the key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// GenerateKeys function returns a new RSA private key and its public key, both PEM-encoded.
+// The private key is encoded in PKCS #1, the public key in PKIX format.
+func GenerateKeys(bits int) ([]byte, []byte, error) {
+
+	priv, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+	return privPEM, pubPEM, nil
+}
+
+// ParsePublicKey function parses a PEM-encoded RSA public key in PKIX or PKCS #1 format.
+func ParsePublicKey(data []byte) (*rsa.PublicKey, error) {
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported public key type %T", key)
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// ParsePrivateKey function parses a PEM-encoded RSA private key in PKCS #1 or PKCS #8 format.
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		priv, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return priv, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// ReadPublicKey function reads the PEM-encoded RSA public key from the file.
+func ReadPublicKey(path string) (*rsa.PublicKey, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKey(data)
+}
+
+// ReadPrivateKey function reads the PEM-encoded RSA private key from the file.
+func ReadPrivateKey(path string) (*rsa.PrivateKey, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(data)
+}
@@ -0,0 +1,105 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+
+	privPEM, pubPEM, err := GenerateKeys(2048)
+	require.NoError(t, err)
+	priv, err := ParsePrivateKey(privPEM)
+	require.NoError(t, err)
+	pub, err := ParsePublicKey(pubPEM)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		plaintext []byte
+	}{
+		{name: "empty body", plaintext: []byte{}},
+		{name: "json body", plaintext: []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)},
+		{name: "large body", plaintext: make([]byte, 1<<20)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, err := Encrypt(pub, tt.plaintext)
+			require.NoError(t, err)
+			plaintext, err := Decrypt(priv, message)
+			require.NoError(t, err)
+			assert.Equal(t, len(tt.plaintext), len(plaintext))
+			assert.Equal(t, string(tt.plaintext), string(plaintext))
+		})
+	}
+}
+
+func TestDecryptInvalid(t *testing.T) {
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	message, err := Encrypt(&priv.PublicKey, []byte("payload"))
+	require.NoError(t, err)
+	tampered := append([]byte{}, message...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		key     *rsa.PrivateKey
+		message []byte
+	}{
+		{name: "wrong key", key: other, message: message},
+		{name: "tampered data", key: priv, message: tampered},
+		{name: "truncated key", key: priv, message: message[:10]},
+		{name: "truncated nonce", key: priv, message: message[:priv.Size()+4]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decrypt(tt.key, tt.message)
+			assert.ErrorIs(t, err, ErrDecrypt)
+		})
+	}
+}
+
+func TestReadKeys(t *testing.T) {
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	files := map[string]*pem.Block{
+		"pkcs1.pem":     {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)},
+		"pkcs8.pem":     {Type: "PRIVATE KEY", Bytes: pkcs8},
+		"pkcs1.pub.pem": {Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&priv.PublicKey)},
+	}
+	for name, block := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600))
+	}
+
+	for _, name := range []string{"pkcs1.pem", "pkcs8.pem"} {
+		key, err := ReadPrivateKey(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.True(t, priv.Equal(key))
+	}
+	pub, err := ReadPublicKey(filepath.Join(dir, "pkcs1.pub.pem"))
+	require.NoError(t, err)
+	assert.True(t, priv.PublicKey.Equal(pub))
+
+	_, err = ReadPublicKey(filepath.Join(dir, "pkcs1.pem"))
+	assert.Error(t, err)
+	_, err = ReadPrivateKey(filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,78 @@
+// Events package contains the in-memory records of the accepted system metrics updates shared by the HTTP and gRPC servers.
+//
+// Available at https://github.com/SiberianMonster/go-musthave-devops-tpl/internal/events
+package events
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+// Seen struct describes the last accepted update of a system metric.
+type Seen struct {
+	Time  time.Time
+	Agent string
+}
+
+// Activity keeps the time and the sender of the last update of every system metric received by the server.
+// It is not persisted, metrics restored from the storage have no activity until they are updated again.
+type Activity struct {
+	mu   sync.RWMutex
+	seen map[string]Seen
+}
+
+// NewActivity function returns empty Activity object.
+func NewActivity() *Activity {
+
+	return &Activity{seen: make(map[string]Seen)}
+}
+
+// Record function remembers the update of the system metrics received from the address.
+// The agent is identified by the instance label of the metric or by the address when the label is not set.
+func (a *Activity) Record(mb []metrics.Metrics, address string, received time.Time) {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, mp := range mb {
+		agent := address
+		if instance := mp.Labels[metrics.InstanceLabel]; instance != "" {
+			agent = instance
+		}
+		a.seen[mp.MType+"/"+metrics.SeriesKey(mp)] = Seen{Time: received, Agent: agent}
+	}
+}
+
+// Forget function drops the activity of the removed system metrics.
+func (a *Activity) Forget(mb []metrics.Metrics) {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, mp := range mb {
+		delete(a.seen, mp.MType+"/"+metrics.SeriesKey(mp))
+	}
+}
+
+// Expire function drops the activity of the gauges that were not updated since the before time,
+// the same gauges are removed from the storage by its Expire function.
+func (a *Activity) Expire(before time.Time) {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, seen := range a.seen {
+		if strings.HasPrefix(key, metrics.Gauge+"/") && seen.Time.Before(before) {
+			delete(a.seen, key)
+		}
+	}
+}
+
+// Get function returns the last update of the system metric.
+func (a *Activity) Get(mp metrics.Metrics) (Seen, bool) {
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	seen, ok := a.seen[mp.MType+"/"+metrics.SeriesKey(mp)]
+	return seen, ok
+}
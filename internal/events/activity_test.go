@@ -0,0 +1,41 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+func TestActivityForgetExpire(t *testing.T) {
+
+	a := NewActivity()
+	old, recent := time.Now().Add(-time.Hour), time.Now()
+	value := 1.0
+	delta := int64(1)
+	gauge := metrics.Metrics{ID: "Alloc", MType: metrics.Gauge, Value: &value}
+	counter := metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Delta: &delta}
+	labeled := metrics.Metrics{ID: "Alloc", MType: metrics.Gauge, Value: &value, Labels: map[string]string{"host": "a"}}
+	a.Record([]metrics.Metrics{gauge, counter}, "127.0.0.1", old)
+	a.Record([]metrics.Metrics{labeled}, "127.0.0.1", recent)
+
+	// only the gauges are removed by the storage expiry, the counters keep their activity
+	a.Expire(recent.Add(-time.Minute))
+	if _, ok := a.Get(gauge); ok {
+		t.Errorf("stale gauge activity is kept after expiry")
+	}
+	if _, ok := a.Get(counter); !ok {
+		t.Errorf("counter activity is dropped by expiry")
+	}
+	if _, ok := a.Get(labeled); !ok {
+		t.Errorf("recent gauge activity is dropped by expiry")
+	}
+
+	a.Forget([]metrics.Metrics{counter, labeled})
+	if _, ok := a.Get(counter); ok {
+		t.Errorf("deleted counter activity is kept")
+	}
+	if _, ok := a.Get(labeled); ok {
+		t.Errorf("deleted gauge activity is kept")
+	}
+}
@@ -0,0 +1,101 @@
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+// SubscriberBuffer is the number of updates queued for a subscriber. Updates that do not fit are dropped.
+const SubscriberBuffer = 256
+
+// Filter selects the updates delivered to a subscriber.
+type Filter func(mp metrics.Metrics) bool
+
+// Broker fans the accepted system metrics updates out to the subscribers.
+// Publishing never blocks: when the queue of a slow subscriber is full the update is dropped for that subscriber
+// and the number of dropped updates can be read with Subscription.Dropped.
+type Broker struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+	// closed is closed by Close to end all the subscriptions.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Subscription struct is a single subscriber with its filter and the queue of pending updates.
+type Subscription struct {
+	filter  Filter
+	updates chan metrics.Metrics
+	dropped int64
+}
+
+// NewBroker function returns Broker object without subscribers.
+func NewBroker() *Broker {
+
+	return &Broker{subs: make(map[*Subscription]struct{}), closed: make(chan struct{})}
+}
+
+// Close function ends the subscriptions of all the subscribers, e.g. on the server shutdown.
+func (b *Broker) Close() {
+
+	b.closeOnce.Do(func() { close(b.closed) })
+}
+
+// Done function returns the channel closed when the broker is closed.
+func (b *Broker) Done() <-chan struct{} {
+
+	return b.closed
+}
+
+// Publish function queues the accepted system metrics updates for the subscribers with matching filters.
+func (b *Broker) Publish(mb []metrics.Metrics, received time.Time) {
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		for _, mp := range mb {
+			if sub.filter != nil && !sub.filter(mp) {
+				continue
+			}
+			mp.Updated = &received
+			select {
+			case sub.updates <- mp:
+			default:
+				atomic.AddInt64(&sub.dropped, 1)
+			}
+		}
+	}
+}
+
+// Subscribe function registers a new subscriber receiving the updates selected by the filter, nil filter selects all the updates.
+func (b *Broker) Subscribe(filter Filter) *Subscription {
+
+	sub := &Subscription{filter: filter, updates: make(chan metrics.Metrics, SubscriberBuffer)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// Unsubscribe function removes the subscriber, no updates are queued for it afterwards.
+func (b *Broker) Unsubscribe(sub *Subscription) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, sub)
+}
+
+// Updates function returns the queue of the updates delivered to the subscriber.
+func (s *Subscription) Updates() <-chan metrics.Metrics {
+
+	return s.updates
+}
+
+// Dropped function returns the number of updates dropped since the previous call.
+func (s *Subscription) Dropped() int64 {
+
+	return atomic.SwapInt64(&s.dropped, 0)
+}
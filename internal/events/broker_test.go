@@ -0,0 +1,42 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+func TestBrokerSlowSubscriber(t *testing.T) {
+
+	b := NewBroker()
+	sub := b.Subscribe(func(mp metrics.Metrics) bool { return mp.MType == metrics.Gauge })
+	defer b.Unsubscribe(sub)
+
+	value := 1.0
+	delta := int64(1)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < SubscriberBuffer+5; i++ {
+			b.Publish([]metrics.Metrics{
+				{ID: "Alloc", MType: metrics.Gauge, Value: &value},
+				{ID: "PollCount", MType: metrics.Counter, Delta: &delta},
+			}, time.Now())
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing is blocked by the subscriber")
+	}
+	if len(sub.Updates()) != SubscriberBuffer {
+		t.Errorf("subscriber has %d queued updates, want %d", len(sub.Updates()), SubscriberBuffer)
+	}
+	if dropped := sub.Dropped(); dropped != 5 {
+		t.Errorf("subscriber has %d dropped updates, want 5", dropped)
+	}
+	if dropped := sub.Dropped(); dropped != 0 {
+		t.Errorf("subscriber has %d dropped updates after reading them, want 0", dropped)
+	}
+}
@@ -0,0 +1,86 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/auth"
+	pb "github.com/SiberianMonster/go-musthave-devops-tpl/internal/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// methodScopes are the token scopes required by the methods of the Metrics service.
+var methodScopes = map[string]string{
+	pb.Metrics_UpdateBatch_FullMethodName: auth.ScopeWrite,
+	pb.Metrics_Stream_FullMethodName:      auth.ScopeWrite,
+	pb.Metrics_Get_FullMethodName:         auth.ScopeRead,
+	pb.Metrics_List_FullMethodName:        auth.ScopeRead,
+}
+
+// AuthUnaryInterceptor function returns the interceptor admitting only the calls
+// with a bearer token in the authorization metadata granting the scope of the method.
+func AuthUnaryInterceptor(a *auth.Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+		ctx, err := authorize(ctx, a, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// AuthStreamInterceptor function returns the stream counterpart of AuthUnaryInterceptor.
+func AuthStreamInterceptor(a *auth.Authenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+
+		ctx, err := authorize(ss.Context(), a, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, authStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authStream struct is the server stream with the context carrying the token the call is authorized with.
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context function returns the context of the stream with the token.
+func (s authStream) Context() context.Context {
+
+	return s.ctx
+}
+
+// authorize function checks the token received in the call metadata, the unknown methods require the admin scope.
+// It returns the context of the call carrying the token.
+func authorize(ctx context.Context, a *auth.Authenticator, method string) (context.Context, error) {
+
+	scope, ok := methodScopes[method]
+	if !ok {
+		scope = auth.ScopeAdmin
+	}
+	var secret string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			secret = auth.BearerToken(values[0])
+		}
+	}
+	t, err := a.Authorize(ctx, secret, scope)
+	switch {
+	case errors.Is(err, auth.ErrUnauthorized):
+		return ctx, status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, auth.ErrForbidden):
+		return ctx, status.Error(codes.PermissionDenied, err.Error())
+	case err != nil:
+		log.Printf("Error happened when checking token. Err: %s", err)
+		return ctx, status.Error(codes.Internal, "token check failed")
+	}
+	return auth.NewContext(ctx, t), nil
+}
@@ -0,0 +1,233 @@
+// Grpcserver package contains the gRPC service receiving and returning system metrics alongside the HTTP endpoints.
+//
+// Available at https://github.com/SiberianMonster/go-musthave-devops-tpl/internal/grpcserver
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/auth"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/config"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/events"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+	pb "github.com/SiberianMonster/go-musthave-devops-tpl/internal/proto"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// MetricsServer implements the Metrics gRPC service on top of the metrics storage.
+// Received metrics are verified with the same HMAC key as the ones received over HTTP.
+// The accepted updates are recorded to the agents activity and published to the event streams shared with the HTTP handlers.
+type MetricsServer struct {
+	pb.UnimplementedMetricsServer
+	st       storage.Storage
+	key      string
+	staleTTL time.Duration
+	activity *events.Activity
+	broker   *events.Broker
+}
+
+// NewMetricsServer function returns MetricsServer object.
+func NewMetricsServer(st storage.Storage, key string, staleTTL time.Duration) *MetricsServer {
+
+	return &MetricsServer{st: st, key: key, staleTTL: staleTTL, activity: events.NewActivity(), broker: events.NewBroker()}
+}
+
+// WithActivity function makes the server record the accepted updates to the activity shared with the HTTP handlers.
+func (s *MetricsServer) WithActivity(a *events.Activity) *MetricsServer {
+
+	s.activity = a
+	return s
+}
+
+// WithBroker function makes the server publish the accepted updates to the broker shared with the HTTP event streams.
+func (s *MetricsServer) WithBroker(b *events.Broker) *MetricsServer {
+
+	s.broker = b
+	return s
+}
+
+// NewServer function returns the gRPC server with the registered Metrics service.
+func NewServer(ms *MetricsServer, opts ...grpc.ServerOption) *grpc.Server {
+
+	srv := grpc.NewServer(opts...)
+	pb.RegisterMetricsServer(srv, ms)
+	return srv
+}
+
+// UpdateBatch function saves a batch of received system metrics.
+func (s *MetricsServer) UpdateBatch(ctx context.Context, req *pb.UpdateBatchRequest) (*pb.UpdateBatchResponse, error) {
+
+	return s.updateBatch(ctx, req)
+}
+
+// Get function returns the stored value of the requested system metric.
+func (s *MetricsServer) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+
+	if req.GetMetric() == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing metric")
+	}
+	mp := pb.ToMetrics(req.GetMetric())
+	if !metrics.ValidType(mp.MType) {
+		return nil, status.Error(codes.InvalidArgument, "invalid type")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.ContextDBTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	mp, err := storage.Resolve(ctx, s.st, mp)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	return &pb.GetResponse{Metric: pb.FromMetrics(s.sign(mp, time.Now()))}, nil
+}
+
+// List function returns the stored system metrics filtered by type and name prefix and ordered by name, type and labels.
+func (s *MetricsServer) List(ctx context.Context, req *pb.ListRequest) (*pb.ListResponse, error) {
+
+	if req.GetType() != "" && !metrics.ValidType(req.GetType()) {
+		return nil, status.Error(codes.InvalidArgument, "invalid type")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.ContextDBTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	metricsList, err := s.st.List(ctx)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	now := time.Now()
+	resp := &pb.ListResponse{}
+	for _, mp := range metricsList {
+		if req.GetType() != "" && mp.MType != req.GetType() {
+			continue
+		}
+		if !strings.HasPrefix(mp.ID, req.GetPrefix()) {
+			continue
+		}
+		resp.Metrics = append(resp.Metrics, pb.FromMetrics(s.sign(mp, now)))
+	}
+	sort.Slice(resp.Metrics, func(i, j int) bool {
+		first, second := resp.Metrics[i], resp.Metrics[j]
+		if first.Id != second.Id {
+			return first.Id < second.Id
+		}
+		if first.Type != second.Type {
+			return first.Type < second.Type
+		}
+		return metrics.LabelsString(first.Labels) < metrics.LabelsString(second.Labels)
+	})
+	return resp, nil
+}
+
+// Stream function saves the batches received over the stream and acknowledges each of them.
+// The stream is closed with the error status of the first rejected batch.
+func (s *MetricsServer) Stream(stream pb.Metrics_StreamServer) error {
+
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := s.updateBatch(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// updateBatch function verifies the hashes of the received system metrics and saves them to the storage.
+func (s *MetricsServer) updateBatch(ctx context.Context, req *pb.UpdateBatchRequest) (*pb.UpdateBatchResponse, error) {
+
+	mb := pb.ToMetricsBatch(req.GetMetrics())
+	for _, mp := range mb {
+		if !metrics.ValidType(mp.MType) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid type of metric %s", mp.ID)
+		}
+		if !metrics.HasValue(mp) {
+			return nil, status.Errorf(codes.InvalidArgument, "missing value of metric %s", mp.ID)
+		}
+		if err := auth.CheckInstance(ctx, mp.Labels[metrics.InstanceLabel]); err != nil {
+			return nil, status.Errorf(codes.PermissionDenied, "metric %s: %s", mp.ID, err)
+		}
+		if s.key == "" {
+			continue
+		}
+		if testHash := metrics.MetricsHash(mp, s.key); testHash != mp.Hash {
+			log.Printf("Hashing values do not match. Value produced: %s. Value received: %s", testHash, mp.Hash)
+			return nil, status.Errorf(codes.Unauthenticated, "received hash of metric %s does not match", mp.ID)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.ContextDBTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	if err := s.st.UpdateBatch(ctx, mb); err != nil {
+		log.Printf("Error happened when saving metrics received over gRPC. Err: %s", err)
+		return nil, storageError(err)
+	}
+	received := time.Now()
+	s.activity.Record(mb, peerAgent(ctx), received)
+	s.broker.Publish(mb, received)
+	return &pb.UpdateBatchResponse{Accepted: uint32(len(mb))}, nil
+}
+
+// peerAgent function returns the address of the agent that made the call.
+func peerAgent(ctx context.Context) string {
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// sign function sets the stale flag and the hash of the system metric returned to the client.
+func (s *MetricsServer) sign(mp metrics.Metrics, now time.Time) metrics.Metrics {
+
+	mp.Stale = s.staleTTL > 0 && mp.MType == metrics.Gauge && mp.Updated != nil && now.Sub(*mp.Updated) > s.staleTTL
+	if s.key != "" {
+		mp.Hash = metrics.MetricsHash(mp, s.key)
+	}
+	return mp
+}
+
+// storageError function converts the storage errors to the gRPC status errors.
+func storageError(err error) error {
+
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, storage.ErrAmbiguous):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, storage.ErrWrongType), errors.Is(err, storage.ErrBucketsMismatch), errors.Is(err, metrics.ErrInvalidLabels):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
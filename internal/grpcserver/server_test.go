@@ -0,0 +1,288 @@
+package grpcserver
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/auth"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/events"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/handlers"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/middleware"
+	pb "github.com/SiberianMonster/go-musthave-devops-tpl/internal/proto"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestClient function serves the Metrics service over an in-memory connection and returns its client.
+func newTestClient(t *testing.T, st storage.Storage, key string, opts ...grpc.ServerOption) pb.MetricsClient {
+
+	return newMetricsServerClient(t, NewMetricsServer(st, key, time.Hour), opts...)
+}
+
+// newMetricsServerClient function serves the configured Metrics service over an in-memory connection and returns its client.
+func newMetricsServerClient(t *testing.T, ms *MetricsServer, opts ...grpc.ServerOption) pb.MetricsClient {
+
+	listen := bufconn.Listen(1 << 20)
+	srv := NewServer(ms, opts...)
+	go srv.Serve(listen)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listen.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewMetricsClient(conn)
+}
+
+func TestMetricsServer(t *testing.T) {
+
+	ctx := context.Background()
+	client := newTestClient(t, storage.NewMemStorage(), "")
+	value := 2.5
+	delta := int64(3)
+
+	resp, err := client.UpdateBatch(ctx, &pb.UpdateBatchRequest{Metrics: pb.FromMetricsBatch([]metrics.Metrics{
+		{ID: "Alloc", MType: metrics.Gauge, Value: &value, Labels: map[string]string{metrics.InstanceLabel: "a"}},
+		{ID: "PollCount", MType: metrics.Counter, Delta: &delta},
+	})})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), resp.GetAccepted())
+
+	got, err := client.Get(ctx, &pb.GetRequest{Metric: &pb.Metric{Id: "Alloc", Type: metrics.Gauge,
+		Labels: map[string]string{metrics.InstanceLabel: "a"}}})
+	require.NoError(t, err)
+	assert.Equal(t, value, got.GetMetric().GetValue())
+	assert.NotNil(t, got.GetMetric().GetUpdated())
+
+	// the metric requested without labels resolves to its single labeled series
+	got, err = client.Get(ctx, &pb.GetRequest{Metric: &pb.Metric{Id: "Alloc", Type: metrics.Gauge}})
+	require.NoError(t, err)
+	assert.Equal(t, value, got.GetMetric().GetValue())
+
+	_, err = client.Get(ctx, &pb.GetRequest{Metric: &pb.Metric{Id: "Sys", Type: metrics.Gauge}})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.UpdateBatch(ctx, &pb.UpdateBatchRequest{Metrics: []*pb.Metric{{Id: "Alloc", Type: metrics.Gauge}}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	list, err := client.List(ctx, &pb.ListRequest{Type: metrics.Counter})
+	require.NoError(t, err)
+	require.Len(t, list.GetMetrics(), 1)
+	assert.Equal(t, delta, list.GetMetrics()[0].GetDelta())
+}
+
+func TestMetricsServerHash(t *testing.T) {
+
+	ctx := context.Background()
+	key := "secret"
+	client := newTestClient(t, storage.NewMemStorage(), key)
+	value := 1.5
+
+	mp := metrics.Metrics{ID: "Alloc", MType: metrics.Gauge, Value: &value}
+	_, err := client.UpdateBatch(ctx, &pb.UpdateBatchRequest{Metrics: []*pb.Metric{pb.FromMetrics(mp)}})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	mp.Hash = metrics.MetricsHash(mp, key)
+	_, err = client.UpdateBatch(ctx, &pb.UpdateBatchRequest{Metrics: []*pb.Metric{pb.FromMetrics(mp)}})
+	require.NoError(t, err)
+
+	got, err := client.Get(ctx, &pb.GetRequest{Metric: &pb.Metric{Id: "Alloc", Type: metrics.Gauge}})
+	require.NoError(t, err)
+	assert.Equal(t, mp.Hash, got.GetMetric().GetHash())
+}
+
+func TestMetricsServerStream(t *testing.T) {
+
+	st := storage.NewMemStorage()
+	client := newTestClient(t, st, "")
+	delta := int64(1)
+
+	stream, err := client.Stream(context.Background())
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, stream.Send(&pb.UpdateBatchRequest{Metrics: pb.FromMetricsBatch([]metrics.Metrics{
+			{ID: "PollCount", MType: metrics.Counter, Delta: &delta},
+		})}))
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, uint32(1), resp.GetAccepted())
+	}
+	require.NoError(t, stream.CloseSend())
+
+	mp, err := st.Get(context.Background(), metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *mp.Delta)
+
+	// the stream is closed on the first rejected batch
+	stream, err = client.Stream(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.UpdateBatchRequest{Metrics: []*pb.Metric{{Id: "PollCount", Type: "summary"}}}))
+	_, err = stream.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestTrustedSubnetInterceptors(t *testing.T) {
+
+	_, subnet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	client := newTestClient(t, storage.NewMemStorage(), "",
+		grpc.UnaryInterceptor(TrustedSubnetUnaryInterceptor(subnet)),
+		grpc.StreamInterceptor(TrustedSubnetStreamInterceptor(subnet)))
+	value := 1.5
+	req := &pb.UpdateBatchRequest{Metrics: pb.FromMetricsBatch([]metrics.Metrics{{ID: "Alloc", MType: metrics.Gauge, Value: &value}})}
+
+	tests := []struct {
+		name     string
+		realIP   string
+		wantCode codes.Code
+	}{
+		{name: "trusted", realIP: "192.168.1.10", wantCode: codes.OK},
+		{name: "outside subnet", realIP: "10.0.0.1", wantCode: codes.PermissionDenied},
+		{name: "missing", wantCode: codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.realIP != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, middleware.RealIPHeader, tt.realIP)
+			}
+			_, err := client.UpdateBatch(ctx, req)
+			assert.Equal(t, tt.wantCode, status.Code(err))
+
+			stream, err := client.Stream(ctx)
+			require.NoError(t, err)
+			require.NoError(t, stream.Send(req))
+			_, err = stream.Recv()
+			assert.Equal(t, tt.wantCode, status.Code(err))
+			stream.CloseSend()
+		})
+	}
+
+	// reading the metrics does not require the trusted address
+	_, err = client.List(context.Background(), &pb.ListRequest{})
+	assert.NoError(t, err)
+}
+
+func TestAuthInterceptors(t *testing.T) {
+
+	ctx := context.Background()
+	store, err := auth.NewFileStore(filepath.Join(t.TempDir(), "tokens.json"))
+	require.NoError(t, err)
+	agent, agentSecret, err := auth.NewToken("agent-1", []string{auth.ScopeWrite})
+	require.NoError(t, err)
+	require.NoError(t, store.Create(ctx, agent))
+	bound, boundSecret, err := auth.NewToken("agent-2", []string{auth.ScopeWrite})
+	require.NoError(t, err)
+	bound.Instance = "agent-2"
+	require.NoError(t, store.Create(ctx, bound))
+	a := auth.NewAuthenticator(store, "root")
+	client := newTestClient(t, storage.NewMemStorage(), "",
+		grpc.UnaryInterceptor(AuthUnaryInterceptor(a)),
+		grpc.StreamInterceptor(AuthStreamInterceptor(a)))
+	value := 1.5
+	req := &pb.UpdateBatchRequest{Metrics: pb.FromMetricsBatch([]metrics.Metrics{{ID: "Alloc", MType: metrics.Gauge, Value: &value}})}
+	withToken := func(secret string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+secret)
+	}
+
+	_, err = client.UpdateBatch(ctx, req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.UpdateBatch(withToken(agentSecret), req)
+	assert.NoError(t, err)
+	_, err = client.UpdateBatch(withToken(boundSecret), req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	labeled := &pb.UpdateBatchRequest{Metrics: pb.FromMetricsBatch([]metrics.Metrics{
+		{ID: "Alloc", MType: metrics.Gauge, Value: &value, Labels: map[string]string{metrics.InstanceLabel: "agent-2"}},
+	})}
+	_, err = client.UpdateBatch(withToken(boundSecret), labeled)
+	assert.NoError(t, err)
+	_, err = client.List(withToken(agentSecret), &pb.ListRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.List(withToken("root"), &pb.ListRequest{})
+	assert.NoError(t, err)
+
+	stream, err := client.Stream(ctx)
+	require.NoError(t, err)
+	stream.Send(req)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// the token reaches the stream handler through the context of the stream
+	stream, err = client.Stream(withToken(boundSecret))
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(labeled))
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+	stream.Send(req)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestUpdateBatchMissingValue(t *testing.T) {
+
+	ctx := context.Background()
+	client := newTestClient(t, storage.NewMemStorage(), "secret")
+
+	for _, mtype := range []string{metrics.Counter, metrics.Gauge, metrics.Histogram} {
+		t.Run(mtype, func(t *testing.T) {
+			req := &pb.UpdateBatchRequest{Metrics: []*pb.Metric{{Id: "x", Type: mtype}}}
+			_, err := client.UpdateBatch(ctx, req)
+			assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+			stream, err := client.Stream(ctx)
+			require.NoError(t, err)
+			require.NoError(t, stream.Send(req))
+			_, err = stream.Recv()
+			assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		})
+	}
+}
+
+func TestUpdateBatchActivityAndStream(t *testing.T) {
+
+	st := storage.NewMemStorage()
+	activity, broker := events.NewActivity(), events.NewBroker()
+	defer broker.Close()
+	client := newMetricsServerClient(t, NewMetricsServer(st, "", time.Hour).WithActivity(activity).WithBroker(broker))
+	ts := httptest.NewServer(http.HandlerFunc(handlers.NewWrapperJSONStruct(st, "").WithBroker(broker).StreamHandler))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	value := 1.5
+	mp := metrics.Metrics{ID: "Alloc", MType: metrics.Gauge, Value: &value, Labels: map[string]string{metrics.InstanceLabel: "agent-1"}}
+	_, err = client.UpdateBatch(context.Background(), &pb.UpdateBatchRequest{Metrics: pb.FromMetricsBatch([]metrics.Metrics{mp})})
+	require.NoError(t, err)
+
+	seen, ok := activity.Get(mp)
+	require.True(t, ok)
+	assert.Equal(t, "agent-1", seen.Agent)
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "data:") {
+			assert.Contains(t, scanner.Text(), `"Alloc"`)
+			return
+		}
+	}
+	t.Fatalf("the stream ended without the update: %v", scanner.Err())
+}
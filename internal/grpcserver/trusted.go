@@ -0,0 +1,61 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/middleware"
+	pb "github.com/SiberianMonster/go-musthave-devops-tpl/internal/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// updateMethods are the methods saving the received system metrics, only they are checked against the trusted subnet.
+var updateMethods = map[string]bool{
+	pb.Metrics_UpdateBatch_FullMethodName: true,
+	pb.Metrics_Stream_FullMethodName:      true,
+}
+
+// TrustedSubnetUnaryInterceptor function returns the interceptor rejecting the updates
+// whose x-real-ip metadata is missing or does not belong to the trusted subnet.
+func TrustedSubnetUnaryInterceptor(subnet *net.IPNet) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+		if updateMethods[info.FullMethod] {
+			if err := checkRealIP(ctx, subnet); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// TrustedSubnetStreamInterceptor function returns the stream counterpart of TrustedSubnetUnaryInterceptor.
+func TrustedSubnetStreamInterceptor(subnet *net.IPNet) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+
+		if updateMethods[info.FullMethod] {
+			if err := checkRealIP(ss.Context(), subnet); err != nil {
+				return err
+			}
+		}
+		return handler(srv, ss)
+	}
+}
+
+// checkRealIP function verifies the agent address received in the request metadata.
+func checkRealIP(ctx context.Context, subnet *net.IPNet) error {
+
+	var realIP string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(middleware.RealIPHeader); len(values) > 0 {
+			realIP = values[0]
+		}
+	}
+	if !middleware.TrustedIP(subnet, realIP) {
+		return status.Error(codes.PermissionDenied, "agent address is not trusted")
+	}
+	return nil
+}
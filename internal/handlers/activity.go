@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+)
+
+// requestAgent function returns the address of the agent that sent the request.
+func requestAgent(r *http.Request) string {
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/config"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+// AgentInfo struct describes an agent known to the server.
+type AgentInfo struct {
+	ID string `json:"id"`
+	// LastSeen is the time of the latest update received from the agent.
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	// Metrics is the number of stored metrics reported by the agent.
+	Metrics int `json:"metrics"`
+}
+
+// AgentsHandler returns the agents that reported metrics with the instance label, ordered by ID.
+func (ws WrapperJSONStruct) AgentsHandler(rw http.ResponseWriter, r *http.Request) {
+
+	resp := make(map[string]string)
+	rw.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	metricsList, err := ws.st.List(ctx)
+	if err != nil {
+		log.Printf("Error happened in retrieving metrics. Err: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		resp["status"] = "list retrieval failed"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(listAgents(metricsList))
+}
+
+// listAgents function groups the stored metrics by the instance label and adds the last update time of every agent.
+// The update times are kept by the storage, so they survive the server restart.
+func listAgents(metricsList []metrics.Metrics) []AgentInfo {
+
+	agents := make(map[string]*AgentInfo)
+	for _, mp := range metricsList {
+		instance := mp.Labels[metrics.InstanceLabel]
+		if instance == "" {
+			continue
+		}
+		agent, ok := agents[instance]
+		if !ok {
+			agent = &AgentInfo{ID: instance}
+			agents[instance] = agent
+		}
+		agent.Metrics++
+		if mp.Updated != nil && (agent.LastSeen == nil || mp.Updated.After(*agent.LastSeen)) {
+			lastSeen := *mp.Updated
+			agent.LastSeen = &lastSeen
+		}
+	}
+
+	list := make([]AgentInfo, 0, len(agents))
+	for _, agent := range agents {
+		list = append(list, *agent)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	_ "embed"
+	"html/template"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/events"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+// DashboardRefresh is the auto-refresh interval of the dashboard page in seconds.
+const DashboardRefresh = 10
+
+//go:embed web/dashboard.html
+var dashboardHTML string
+
+//go:embed web/dashboard.css
+var dashboardCSS string
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(dashboardHTML))
+
+// dashboardRow struct is a single system metric shown on the dashboard.
+// Updated is the update time kept by the storage, Agent is the sender of the last update received since the server start.
+type dashboardRow struct {
+	ID      string
+	Value   string
+	Updated *time.Time
+	Agent   string
+}
+
+// dashboardGroup struct holds the dashboard rows of a single metric type.
+type dashboardGroup struct {
+	Type string
+	Rows []dashboardRow
+}
+
+// dashboardPage struct is the data of the dashboard template.
+type dashboardPage struct {
+	Now     time.Time
+	Refresh int
+	Style   template.CSS
+	Groups  []dashboardGroup
+}
+
+// renderDashboard function writes the html page listing the system metrics grouped by type.
+func renderDashboard(w io.Writer, metricsList []metrics.Metrics, activity *events.Activity) error {
+
+	groups := []dashboardGroup{{Type: metrics.Gauge}, {Type: metrics.Counter}, {Type: metrics.Histogram}}
+	for _, mp := range metricsList {
+		row := dashboardRow{ID: metrics.SeriesKey(mp), Value: valueString(mp), Updated: mp.Updated}
+		if seen, ok := activity.Get(mp); ok {
+			row.Agent = seen.Agent
+		}
+		for i := range groups {
+			if groups[i].Type == mp.MType {
+				groups[i].Rows = append(groups[i].Rows, row)
+			}
+		}
+	}
+	for _, group := range groups {
+		rows := group.Rows
+		sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+	}
+
+	return dashboardTemplate.Execute(w, dashboardPage{
+		Now:     time.Now(),
+		Refresh: DashboardRefresh,
+		Style:   template.CSS(dashboardCSS),
+		Groups:  groups,
+	})
+}
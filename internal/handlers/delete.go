@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/auth"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/config"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/storage"
+	"github.com/gorilla/mux"
+)
+
+// HashHeader is the request header carrying metrics.ActionHash of the url-encoded delete and reset requests.
+const HashHeader = "Hash"
+
+// HashTimeHeader is the request header carrying the unix time the delete and reset requests were signed at.
+const HashTimeHeader = "Hash-Time"
+
+// ActionMaxAge is how long the signed delete and reset requests are accepted for,
+// so a captured request cannot be replayed afterwards.
+const ActionMaxAge = time.Minute
+
+// DeleteHandler enables removing a stored system metric requested in url-encoded format.
+func (ws WrapperJSONStruct) DeleteHandler(rw http.ResponseWriter, r *http.Request) {
+
+	urlPart := mux.Vars(r)
+	mp := metrics.Metrics{ID: urlPart["name"], MType: urlPart["type"], Hash: r.Header.Get(HashHeader)}
+
+	ws.serveAction(rw, r, metrics.ActionDelete, mp, ws.delete)
+}
+
+// ResetHandler enables setting a stored counter requested in url-encoded format to zero.
+func (ws WrapperJSONStruct) ResetHandler(rw http.ResponseWriter, r *http.Request) {
+
+	urlPart := mux.Vars(r)
+	mp := metrics.Metrics{ID: urlPart["name"], MType: urlPart["type"], Hash: r.Header.Get(HashHeader)}
+
+	ws.serveAction(rw, r, metrics.ActionReset, mp, ws.st.Reset)
+}
+
+// DeleteBatchJSONHandler enables removing multiple system metrics listed in single json-encoded request body.
+// Metrics that are not stored are skipped.
+func (ws WrapperJSONStruct) DeleteBatchJSONHandler(rw http.ResponseWriter, r *http.Request) {
+
+	resp := make(map[string]string)
+	rw.Header().Set("Content-Type", "application/json")
+	metricsBatch := []metrics.Metrics{}
+
+	err := json.NewDecoder(r.Body).Decode(&metricsBatch)
+
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		resp["status"] = "error when decoding batch"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+
+	defer r.Body.Close()
+
+	for _, mp := range metricsBatch {
+		if status, message := ws.checkAction(r.Context(), metrics.ActionDelete, mp, r.Header.Get(HashTimeHeader)); status != http.StatusOK {
+			rw.WriteHeader(status)
+			resp["status"] = message
+			jsonResp, err := json.Marshal(resp)
+			if err != nil {
+				log.Printf("Error happened in JSON marshal. Err: %s", err)
+				return
+			}
+			rw.Write(jsonResp)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	err = ws.st.DeleteBatch(ctx, metricsBatch)
+	if err != nil {
+		rw.WriteHeader(http.StatusNotImplemented)
+		resp["status"] = "batch delete failed"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+	ws.activity.Forget(metricsBatch)
+	rw.WriteHeader(http.StatusOK)
+	resp["status"] = "ok"
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", err)
+		return
+	}
+	rw.Write(jsonResp)
+}
+
+// delete function removes the stored system metric together with its activity.
+func (ws WrapperJSONStruct) delete(ctx context.Context, mp metrics.Metrics) error {
+
+	if err := ws.st.Delete(ctx, mp); err != nil {
+		return err
+	}
+	ws.activity.Forget([]metrics.Metrics{mp})
+	return nil
+}
+
+// serveAction function checks the requested action on a single system metric, performs it and writes the json-encoded status.
+// The labels of the metric are read from the query parameters.
+func (ws WrapperJSONStruct) serveAction(rw http.ResponseWriter, r *http.Request, action string, mp metrics.Metrics,
+	perform func(ctx context.Context, mp metrics.Metrics) error) {
+
+	resp := make(map[string]string)
+	rw.Header().Set("Content-Type", "application/json")
+
+	status, message := http.StatusBadRequest, "wrong labels"
+	labels, err := requestLabels(r)
+	if err == nil {
+		mp.Labels = labels
+		status, message = ws.checkAction(r.Context(), action, mp, r.Header.Get(HashTimeHeader))
+	}
+	if status == http.StatusOK {
+		ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
+		// не забываем освободить ресурс
+		defer cancel()
+
+		err = perform(ctx, mp)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			status, message = http.StatusNotFound, "missing parameter"
+		case errors.Is(err, storage.ErrWrongType):
+			status, message = http.StatusBadRequest, "only counters can be reset"
+		case err != nil:
+			log.Printf("Error happened when performing %s action. Err: %s", action, err)
+			status, message = http.StatusNotImplemented, action+" failed"
+		}
+	}
+
+	rw.WriteHeader(status)
+	resp["status"] = message
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", err)
+		return
+	}
+	rw.Write(jsonResp)
+}
+
+// checkAction function validates the metric type and, when the hashing key is set, the action hash of the request
+// and the time it was signed at, which must be within ActionMaxAge of the server time.
+// The token of the request must be allowed to write the instance of the metric.
+// It returns http.StatusOK and "ok" for the accepted requests or the error status and message otherwise.
+func (ws WrapperJSONStruct) checkAction(ctx context.Context, action string, mp metrics.Metrics, hashTime string) (int, string) {
+
+	if !metrics.ValidType(mp.MType) {
+		return http.StatusNotImplemented, "invalid type"
+	}
+	if err := auth.CheckInstance(ctx, mp.Labels[metrics.InstanceLabel]); err != nil {
+		return http.StatusForbidden, err.Error()
+	}
+	if ws.key != "" {
+		signedAt, err := strconv.ParseInt(hashTime, 10, 64)
+		if err != nil {
+			return http.StatusBadRequest, "missing signing time"
+		}
+		if age := time.Since(time.Unix(signedAt, 0)); age > ActionMaxAge || age < -ActionMaxAge {
+			log.Printf("Signed %s request is %s old", action, age)
+			return http.StatusBadRequest, "signature expired"
+		}
+		testHash := metrics.ActionHash(action, mp, signedAt, ws.key)
+		if testHash != mp.Hash {
+			log.Printf("Hashing values do not match. Value produced: %s. Value received: %s", testHash, mp.Hash)
+			return http.StatusBadRequest, "received hash does not match"
+		}
+	}
+	return http.StatusOK, "ok"
+}
@@ -4,43 +4,85 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/auth"
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/config"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/events"
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/storage"
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
 )
 
-var err error
-var resp map[string]string
-var testHash string
+// StaleHeader is set in the url-encoded value responses of the gauges that were not updated within the stale ttl.
+const StaleHeader = "X-Metric-Stale"
 
-// WrapperJSONStruct enables using SQL database instanse and the hashing option for endpoint handlers.
+// WrapperJSONStruct enables using the metrics storage and the hashing option for endpoint handlers.
 type WrapperJSONStruct struct {
-	key    string
-	dB     *sql.DB
-	dBFlag bool
+	key      string
+	st       storage.Storage
+	activity *events.Activity
+	broker   *events.Broker
+	tokens   auth.Store
+	// staleTTL is the time after which the gauges that were not updated are flagged as stale, zero disables the flag.
+	staleTTL time.Duration
 }
 
 // NewWrapperJSONStruct function returns WrapperJSONStruct object.
-func NewWrapperJSONStruct() WrapperJSONStruct {
+func NewWrapperJSONStruct(st storage.Storage, key string) WrapperJSONStruct {
 
-	ws := WrapperJSONStruct{key: config.Key, dB: config.DB, dBFlag: config.DBFlag}
+	ws := WrapperJSONStruct{key: key, st: st, activity: events.NewActivity(), broker: events.NewBroker()}
 	return ws
 }
 
-// UpdateJSONHandler enables reveiving new system metrics in json-encoded request body. 
+// WithStaleTTL function returns a copy of WrapperJSONStruct flagging the gauges not updated within the ttl as stale.
+func (ws WrapperJSONStruct) WithStaleTTL(ttl time.Duration) WrapperJSONStruct {
+
+	ws.staleTTL = ttl
+	return ws
+}
+
+// WithActivity function returns a copy of WrapperJSONStruct recording the accepted updates to the activity,
+// so it can be shared with the other transports.
+func (ws WrapperJSONStruct) WithActivity(a *events.Activity) WrapperJSONStruct {
+
+	ws.activity = a
+	return ws
+}
+
+// WithBroker function returns a copy of WrapperJSONStruct publishing the accepted updates to the broker.
+func (ws WrapperJSONStruct) WithBroker(b *events.Broker) WrapperJSONStruct {
+
+	ws.broker = b
+	return ws
+}
+
+// accepted function records the activity of the saved system metrics and publishes them to the stream subscribers.
+func (ws WrapperJSONStruct) accepted(mb []metrics.Metrics, r *http.Request) {
+
+	received := time.Now()
+	ws.activity.Record(mb, requestAgent(r), received)
+	ws.broker.Publish(mb, received)
+}
+
+// markStale function sets the stale flag of the gauge that was not updated within the ttl.
+func (ws WrapperJSONStruct) markStale(mp *metrics.Metrics, now time.Time) {
+
+	mp.Stale = ws.staleTTL > 0 && mp.MType == metrics.Gauge && mp.Updated != nil && now.Sub(*mp.Updated) > ws.staleTTL
+}
+
+// UpdateJSONHandler enables reveiving new system metrics in json-encoded request body.
 func (ws WrapperJSONStruct) UpdateJSONHandler(rw http.ResponseWriter, r *http.Request) {
 
-	resp = make(map[string]string)
+	resp := make(map[string]string)
 	rw.Header().Set("Content-Type", "application/json")
 	rw.Header().Set("Connection", "close")
 	var updateParams metrics.Metrics
@@ -73,7 +115,7 @@ func (ws WrapperJSONStruct) UpdateJSONHandler(rw http.ResponseWriter, r *http.Re
 
 	defer r.Body.Close()
 
-	if updateParams.MType != metrics.Counter && updateParams.MType != metrics.Gauge {
+	if !metrics.ValidType(updateParams.MType) {
 		rw.WriteHeader(http.StatusNotImplemented)
 		resp["status"] = "invalid type"
 		jsonResp, err := json.Marshal(resp)
@@ -87,7 +129,7 @@ func (ws WrapperJSONStruct) UpdateJSONHandler(rw http.ResponseWriter, r *http.Re
 
 	if ws.key != "" {
 
-		testHash = metrics.MetricsHash(updateParams, ws.key)
+		testHash := metrics.MetricsHash(updateParams, ws.key)
 
 		if testHash != updateParams.Hash {
 			log.Printf("Hashing values do not match. Value produced: %s. Value received: %s", testHash, updateParams.Hash)
@@ -103,11 +145,34 @@ func (ws WrapperJSONStruct) UpdateJSONHandler(rw http.ResponseWriter, r *http.Re
 		}
 	}
 
+	if err = auth.CheckInstance(r.Context(), updateParams.Labels[metrics.InstanceLabel]); err != nil {
+		rw.WriteHeader(http.StatusForbidden)
+		resp["status"] = err.Error()
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
 	// не забываем освободить ресурс
 	defer cancel()
 
-	err = storage.RepositoryUpdate(updateParams, ws.dB, ws.dBFlag, ctx)
+	err = ws.st.Update(ctx, updateParams)
+	if errors.Is(err, storage.ErrBucketsMismatch) {
+		rw.WriteHeader(http.StatusBadRequest)
+		resp["status"] = "histogram buckets do not match"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
 	if err != nil {
 		rw.WriteHeader(http.StatusNotImplemented)
 		resp["status"] = "update failed"
@@ -119,6 +184,7 @@ func (ws WrapperJSONStruct) UpdateJSONHandler(rw http.ResponseWriter, r *http.Re
 		rw.Write(jsonResp)
 		return
 	}
+	ws.accepted([]metrics.Metrics{updateParams}, r)
 
 	rw.WriteHeader(http.StatusOK)
 	resp["status"] = "ok"
@@ -134,7 +200,7 @@ func (ws WrapperJSONStruct) UpdateJSONHandler(rw http.ResponseWriter, r *http.Re
 // UpdateStringHandler enables reveiving new system metrics in url-encoded format.
 func (ws WrapperJSONStruct) UpdateStringHandler(rw http.ResponseWriter, r *http.Request) {
 
-	resp = make(map[string]string)
+	resp := make(map[string]string)
 	rw.Header().Set("Content-Type", "application/json")
 
 	urlPart := mux.Vars(r)
@@ -166,18 +232,42 @@ func (ws WrapperJSONStruct) UpdateStringHandler(rw http.ResponseWriter, r *http.
 		rw.Write(jsonResp)
 		return
 	}
+	labels, err := requestLabels(r)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		resp["status"] = "wrong labels"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
 	if fieldType == metrics.Counter {
 		fvCounter := int64(fv)
-		structParams = metrics.Metrics{ID: urlPart["name"], MType: urlPart["type"], Delta: &fvCounter}
+		structParams = metrics.Metrics{ID: urlPart["name"], MType: urlPart["type"], Delta: &fvCounter, Labels: labels}
 	} else {
-		structParams = metrics.Metrics{ID: urlPart["name"], MType: urlPart["type"], Value: &fv}
+		structParams = metrics.Metrics{ID: urlPart["name"], MType: urlPart["type"], Value: &fv, Labels: labels}
+	}
+
+	if err = auth.CheckInstance(r.Context(), structParams.Labels[metrics.InstanceLabel]); err != nil {
+		rw.WriteHeader(http.StatusForbidden)
+		resp["status"] = err.Error()
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
 	// не забываем освободить ресурс
 	defer cancel()
 
-	err = storage.RepositoryUpdate(structParams, ws.dB, ws.dBFlag, ctx)
+	err = ws.st.Update(ctx, structParams)
 	if err != nil {
 		rw.WriteHeader(http.StatusNotImplemented)
 		resp["status"] = "update failed"
@@ -189,6 +279,7 @@ func (ws WrapperJSONStruct) UpdateStringHandler(rw http.ResponseWriter, r *http.
 		rw.Write(jsonResp)
 		return
 	}
+	ws.accepted([]metrics.Metrics{structParams}, r)
 	rw.WriteHeader(http.StatusOK)
 	resp["status"] = "ok"
 	jsonResp, err := json.Marshal(resp)
@@ -200,10 +291,10 @@ func (ws WrapperJSONStruct) UpdateStringHandler(rw http.ResponseWriter, r *http.
 
 }
 
-// UpdateBatchJSONHandler enables reveiving multiple system metrics objects in single json-encoded request body. 
+// UpdateBatchJSONHandler enables reveiving multiple system metrics objects in single json-encoded request body.
 func (ws WrapperJSONStruct) UpdateBatchJSONHandler(rw http.ResponseWriter, r *http.Request) {
 
-	resp = make(map[string]string)
+	resp := make(map[string]string)
 	rw.Header().Set("Content-Type", "application/json")
 	rw.Header().Set("Connection", "close")
 	metricsBatch := []metrics.Metrics{}
@@ -224,15 +315,10 @@ func (ws WrapperJSONStruct) UpdateBatchJSONHandler(rw http.ResponseWriter, r *ht
 
 	defer r.Body.Close()
 
-	ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
-	// не забываем освободить ресурс
-	defer cancel()
-
-	if ws.dB != nil {
-		err = storage.DBSaveBatch(ws.dB, metricsBatch, ctx)
-		if err != nil {
-			rw.WriteHeader(http.StatusNotImplemented)
-			resp["status"] = "batch update failed"
+	for _, mp := range metricsBatch {
+		if err = auth.CheckInstance(r.Context(), mp.Labels[metrics.InstanceLabel]); err != nil {
+			rw.WriteHeader(http.StatusForbidden)
+			resp["status"] = err.Error()
 			jsonResp, err := json.Marshal(resp)
 			if err != nil {
 				log.Printf("Error happened in JSON marshal. Err: %s", err)
@@ -242,12 +328,35 @@ func (ws WrapperJSONStruct) UpdateBatchJSONHandler(rw http.ResponseWriter, r *ht
 			return
 		}
 	}
-	s, err := json.Marshal(metrics.Container)
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	err = ws.st.UpdateBatch(ctx, metricsBatch)
+	if errors.Is(err, storage.ErrBucketsMismatch) {
+		rw.WriteHeader(http.StatusBadRequest)
+		resp["status"] = "histogram buckets do not match"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
 	if err != nil {
-		log.Printf("Error happened in JSON marshal. Err: %s", err)
+		rw.WriteHeader(http.StatusNotImplemented)
+		resp["status"] = "batch update failed"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
 		return
 	}
-	log.Print(string(s))
+	ws.accepted(metricsBatch, r)
 	rw.WriteHeader(http.StatusOK)
 	resp["status"] = "ok"
 	jsonResp, err := json.Marshal(resp)
@@ -259,10 +368,10 @@ func (ws WrapperJSONStruct) UpdateBatchJSONHandler(rw http.ResponseWriter, r *ht
 
 }
 
-// ValueJSONHandler enables returning stored system metrics objects upon request with json-encoded body. 
+// ValueJSONHandler enables returning stored system metrics objects upon request with json-encoded body.
 func (ws WrapperJSONStruct) ValueJSONHandler(rw http.ResponseWriter, r *http.Request) {
 
-	resp = make(map[string]string)
+	resp := make(map[string]string)
 	rw.Header().Set("Content-Type", "application/json")
 	var receivedParams metrics.Metrics
 
@@ -286,15 +395,33 @@ func (ws WrapperJSONStruct) ValueJSONHandler(rw http.ResponseWriter, r *http.Req
 	// не забываем освободить ресурс
 	defer cancel()
 
-	var ok bool
-	if ws.dBFlag {
-		ok = storage.DBCheck(ws.dB, receivedParams.ID, ctx)
+	if !metrics.ValidType(receivedParams.MType) {
+		rw.WriteHeader(http.StatusNotImplemented)
+		resp["status"] = "invalid type"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+
+	retrievedMetrics, getErr := storage.Resolve(ctx, ws.st, receivedParams)
 
-	} else {
-		_, ok = metrics.Container[receivedParams.ID]
+	if errors.Is(getErr, storage.ErrAmbiguous) {
+		rw.WriteHeader(http.StatusConflict)
+		resp["status"] = "several series match, specify the labels"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
 	}
 
-	if !ok {
+	if errors.Is(getErr, storage.ErrNotFound) {
 		log.Printf("missing params value")
 		receivedS, err := json.Marshal(receivedParams)
 		if err != nil {
@@ -313,9 +440,9 @@ func (ws WrapperJSONStruct) ValueJSONHandler(rw http.ResponseWriter, r *http.Req
 		return
 	}
 
-	if receivedParams.MType != metrics.Counter && receivedParams.MType != metrics.Gauge {
-		rw.WriteHeader(http.StatusNotImplemented)
-		resp["status"] = "invalid type"
+	if getErr != nil {
+		rw.WriteHeader(http.StatusNotFound)
+		resp["status"] = "value retrieval failed"
 		jsonResp, err := json.Marshal(resp)
 		if err != nil {
 			log.Printf("Error happened in JSON marshal. Err: %s", err)
@@ -325,25 +452,13 @@ func (ws WrapperJSONStruct) ValueJSONHandler(rw http.ResponseWriter, r *http.Req
 		return
 	}
 
-	retrievedMetrics, getErr := storage.RepositoryRetrieve(receivedParams, ws.dB, ws.dBFlag, ctx)
-
 	if ws.key != "" {
 
 		retrievedMetrics.Hash = metrics.MetricsHash(retrievedMetrics, ws.key)
 
 	}
+	ws.markStale(&retrievedMetrics, time.Now())
 	log.Println(retrievedMetrics)
-	if getErr != nil {
-		rw.WriteHeader(http.StatusNotFound)
-		resp["status"] = "value retrieval failed"
-		jsonResp, err := json.Marshal(resp)
-		if err != nil {
-			log.Printf("Error happened in JSON marshal. Err: %s", err)
-			return
-		}
-		rw.Write(jsonResp)
-		return
-	}
 
 	rw.WriteHeader(http.StatusOK)
 	json.NewEncoder(rw).Encode(retrievedMetrics)
@@ -352,7 +467,7 @@ func (ws WrapperJSONStruct) ValueJSONHandler(rw http.ResponseWriter, r *http.Req
 // ValueStringHandler enables returning stored system metrics objects upon request in url-encoded format.
 func (ws WrapperJSONStruct) ValueStringHandler(rw http.ResponseWriter, r *http.Request) {
 
-	resp = make(map[string]string)
+	resp := make(map[string]string)
 
 	urlPart := mux.Vars(r)
 	log.Printf(urlPart["name"])
@@ -364,19 +479,10 @@ func (ws WrapperJSONStruct) ValueStringHandler(rw http.ResponseWriter, r *http.R
 	// не забываем освободить ресурс
 	defer cancel()
 
-	var ok bool
-	if ws.dBFlag {
-
-		ok = storage.DBCheck(ws.dB, params, ctx)
-
-	} else {
-		_, ok = metrics.Container[params]
-	}
-
-	if !ok {
+	if !metrics.ValidType(fieldType) {
 		rw.Header().Set("Content-Type", "application/json")
-		rw.WriteHeader(http.StatusNotFound)
-		resp["status"] = "missing parameter"
+		rw.WriteHeader(http.StatusNotImplemented)
+		resp["status"] = "invalid type"
 		jsonResp, err := json.Marshal(resp)
 		if err != nil {
 			log.Printf("Error happened in JSON marshal. Err: %s", err)
@@ -385,10 +491,12 @@ func (ws WrapperJSONStruct) ValueStringHandler(rw http.ResponseWriter, r *http.R
 		rw.Write(jsonResp)
 		return
 	}
-	if fieldType != metrics.Counter && fieldType != metrics.Gauge {
+
+	labels, err := requestLabels(r)
+	if err != nil {
 		rw.Header().Set("Content-Type", "application/json")
-		rw.WriteHeader(http.StatusNotImplemented)
-		resp["status"] = "invalid type"
+		rw.WriteHeader(http.StatusBadRequest)
+		resp["status"] = "wrong labels"
 		jsonResp, err := json.Marshal(resp)
 		if err != nil {
 			log.Printf("Error happened in JSON marshal. Err: %s", err)
@@ -398,10 +506,34 @@ func (ws WrapperJSONStruct) ValueStringHandler(rw http.ResponseWriter, r *http.R
 		return
 	}
 
-	var structParams = metrics.Metrics{ID: params, MType: urlPart["name"]}
+	var structParams = metrics.Metrics{ID: params, MType: fieldType, Labels: labels}
 
-	retrievedMetrics, getErr := storage.RepositoryRetrieveString(structParams, ws.dB, ws.dBFlag, ctx)
+	retrievedMetrics, getErr := storage.Resolve(ctx, ws.st, structParams)
 
+	if errors.Is(getErr, storage.ErrAmbiguous) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusConflict)
+		resp["status"] = "several series match, specify the labels"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+	if errors.Is(getErr, storage.ErrNotFound) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusNotFound)
+		resp["status"] = "missing parameter"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
 	if getErr != nil {
 		rw.Header().Set("Content-Type", "application/json")
 		rw.WriteHeader(http.StatusNotFound)
@@ -415,33 +547,53 @@ func (ws WrapperJSONStruct) ValueStringHandler(rw http.ResponseWriter, r *http.R
 		return
 	}
 
+	ws.markStale(&retrievedMetrics, time.Now())
+	if retrievedMetrics.Stale {
+		rw.Header().Set(StaleHeader, "true")
+	}
 	rw.Header().Set("Content-Type", "text/html; charset=UTF-8")
 	rw.WriteHeader(http.StatusOK)
-	rw.Write([]byte(retrievedMetrics))
+	rw.Write([]byte(valueString(retrievedMetrics)))
 
 }
 
 // GenericHandler handles request to the server with no specific endpoint.
+// It renders the html dashboard listing all the stored system metrics grouped by type.
 func (ws WrapperJSONStruct) GenericHandler(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Set("Content-Type", "text/html; charset=UTF-8")
 	log.Printf("Got to generic endpoint")
-	s, err := json.Marshal(metrics.Container)
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	metricsList, err := ws.st.List(ctx)
 	if err != nil {
-		log.Printf("Error happened in JSON marshal. Err: %s", err)
+		log.Printf("Error happened in retrieving metrics. Err: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var page bytes.Buffer
+	if err = renderDashboard(&page, metricsList, ws.activity); err != nil {
+		log.Printf("Error happened in rendering dashboard. Err: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	log.Print(string(s))
 	rw.WriteHeader(http.StatusOK)
-	rw.Write([]byte(string(s)))
+	rw.Write(page.Bytes())
 }
 
 // PostgresHandler sends ping requests to the database to check existing connection.
 func (ws WrapperJSONStruct) PostgresHandler(rw http.ResponseWriter, r *http.Request) {
 
-	resp = make(map[string]string)
+	resp := make(map[string]string)
 	rw.Header().Set("Content-Type", "application/json")
 
-	pingErr := ws.dB.Ping()
+	ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	pingErr := ws.st.Ping(ctx)
 	if pingErr != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
 		resp["status"] = "failed connection to the database"
@@ -463,3 +615,164 @@ func (ws WrapperJSONStruct) PostgresHandler(rw http.ResponseWriter, r *http.Requ
 	}
 	rw.Write(jsonResp)
 }
+
+// HistoryHandler returns the samples of a system metric received within the requested time range.
+// When the step parameter is set, the samples are aggregated into step-long points.
+func (ws WrapperJSONStruct) HistoryHandler(rw http.ResponseWriter, r *http.Request) {
+
+	resp := make(map[string]string)
+	rw.Header().Set("Content-Type", "application/json")
+
+	urlPart := mux.Vars(r)
+	fieldType := urlPart["type"]
+
+	if fieldType != metrics.Counter && fieldType != metrics.Gauge {
+		rw.WriteHeader(http.StatusNotImplemented)
+		resp["status"] = "invalid type"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+
+	hs, ok := ws.st.(storage.HistoryStorage)
+	if !ok {
+		rw.WriteHeader(http.StatusNotImplemented)
+		resp["status"] = "history disabled"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+
+	labels, err := requestLabels(r)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		resp["status"] = "wrong labels"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+
+	from, to, step, err := parseHistoryRange(r)
+	if err != nil {
+		log.Printf("Error happened in parsing history range. Err: %s", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		resp["status"] = "wrong history range"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	samples, err := hs.History(ctx, metrics.Metrics{ID: urlPart["name"], MType: fieldType, Labels: labels}, from, to)
+	if err != nil {
+		status := http.StatusInternalServerError
+		resp["status"] = "history retrieval failed"
+		if errors.Is(err, storage.ErrHistoryDisabled) {
+			status = http.StatusNotImplemented
+			resp["status"] = "history disabled"
+		}
+		rw.WriteHeader(status)
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	if step == 0 {
+		json.NewEncoder(rw).Encode(samples)
+		return
+	}
+	json.NewEncoder(rw).Encode(storage.Aggregate(fieldType, samples, from, step))
+}
+
+// parseHistoryRange function reads from, to and step query parameters of the history request.
+// Time values are accepted in RFC 3339 format or as unix seconds, the default range is the last hour.
+func parseHistoryRange(r *http.Request) (time.Time, time.Time, time.Duration, error) {
+
+	var step time.Duration
+	query := r.URL.Query()
+
+	to := time.Now()
+	if value := query.Get("to"); value != "" {
+		parsed, err := parseTime(value)
+		if err != nil {
+			return to, to, step, err
+		}
+		to = parsed
+	}
+	from := to.Add(-time.Hour)
+	if value := query.Get("from"); value != "" {
+		parsed, err := parseTime(value)
+		if err != nil {
+			return from, to, step, err
+		}
+		from = parsed
+	}
+	if from.After(to) {
+		return from, to, step, errors.New("from is after to")
+	}
+	if value := query.Get("step"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return from, to, step, err
+		}
+		if parsed <= 0 {
+			return from, to, step, errors.New("step must be positive")
+		}
+		step = parsed
+	}
+	return from, to, step, nil
+}
+
+// parseTime function parses time in RFC 3339 format or as unix seconds.
+func parseTime(value string) (time.Time, error) {
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// valueString function formats the value of a system metric for the url-encoded responses.
+// Histograms are returned json-encoded.
+func valueString(mp metrics.Metrics) string {
+
+	if mp.Delta != nil {
+		return strconv.FormatInt(*mp.Delta, 10)
+	}
+	if mp.Value != nil {
+		return fmt.Sprintf("%v", *mp.Value)
+	}
+	if mp.Histogram != nil {
+		data, err := json.Marshal(mp.Histogram)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return ""
+		}
+		return string(data)
+	}
+	return ""
+}
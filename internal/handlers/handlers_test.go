@@ -1,14 +1,22 @@
 package handlers
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/events"
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/storage"
 	"github.com/gorilla/mux"
 )
 
@@ -74,7 +82,7 @@ func TestUpdateJSONHandler(t *testing.T) {
 		}
 
 		rr := httptest.NewRecorder()
-		handlersWithKey := NewWrapperJSONStruct()
+		handlersWithKey := NewWrapperJSONStruct(storage.NewMemStorage(), "")
 
 		handler := http.HandlerFunc(handlersWithKey.UpdateJSONHandler)
 
@@ -101,7 +109,7 @@ func TestUpdateStringHandler(t *testing.T) {
 	// pass 'nil' as the third parameter.
 
 	r := mux.NewRouter()
-	handlersWithKey := NewWrapperJSONStruct()
+	handlersWithKey := NewWrapperJSONStruct(storage.NewMemStorage(), "")
 	r.HandleFunc("/update/{type}/{name}/{value}", handlersWithKey.UpdateStringHandler)
 	ts := httptest.NewServer(r)
 	defer ts.Close()
@@ -153,7 +161,7 @@ func TestUpdateBatchJSONHandler(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	handlersWithKey := NewWrapperJSONStruct()
+	handlersWithKey := NewWrapperJSONStruct(storage.NewMemStorage(), "")
 
 	handler := http.HandlerFunc(handlersWithKey.UpdateBatchJSONHandler)
 
@@ -187,7 +195,7 @@ func TestValueJSONHandler(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	handlersWithKey := NewWrapperJSONStruct()
+	handlersWithKey := NewWrapperJSONStruct(storage.NewMemStorage(), "")
 
 	handler := http.HandlerFunc(handlersWithKey.ValueJSONHandler)
 
@@ -212,7 +220,7 @@ func TestValueStringHandler(t *testing.T) {
 	// pass 'nil' as the third parameter.
 
 	r := mux.NewRouter()
-	handlersWithKey := NewWrapperJSONStruct()
+	handlersWithKey := NewWrapperJSONStruct(storage.NewMemStorage(), "")
 	r.HandleFunc("/value/{type}/{name}", handlersWithKey.ValueStringHandler)
 	ts := httptest.NewServer(r)
 	defer ts.Close()
@@ -245,3 +253,948 @@ func TestValueStringHandler(t *testing.T) {
 			string(respBody), expected)
 	}
 }
+
+func TestValueStringHandlerStored(t *testing.T) {
+
+	st := storage.NewMemStorage()
+	delta := int64(5)
+	err := st.Update(context.Background(), metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Delta: &delta})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	handlersWithKey := NewWrapperJSONStruct(st, "")
+	r.HandleFunc("/value/{type}/{name}", handlersWithKey.ValueStringHandler)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/value/counter/PollCount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if status := resp.StatusCode; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	expected := `5`
+	if string(respBody) != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			string(respBody), expected)
+	}
+}
+
+func TestParallelUpdates(t *testing.T) {
+
+	st := storage.NewMemStorage()
+	r := mux.NewRouter()
+	handlersWithKey := NewWrapperJSONStruct(st, "")
+	r.HandleFunc("/update/", handlersWithKey.UpdateJSONHandler)
+	r.HandleFunc("/updates/", handlersWithKey.UpdateBatchJSONHandler)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	delta := int64(1)
+	counterObj := metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Delta: &delta}
+	single, _ := json.Marshal(counterObj)
+	batch, _ := json.Marshal([]metrics.Metrics{counterObj, counterObj})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(ts.URL+"/update/", "application/json", bytes.NewBuffer(single))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(ts.URL+"/updates/", "application/json", bytes.NewBuffer(batch))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	mp, err := st.Get(context.Background(), metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *mp.Delta != 60 {
+		t.Errorf("storage returned unexpected counter: got %v want %v", *mp.Delta, 60)
+	}
+}
+
+func TestTypeNamespaces(t *testing.T) {
+
+	r := mux.NewRouter()
+	handlersWithKey := NewWrapperJSONStruct(storage.NewMemStorage(), "")
+	r.HandleFunc("/value/", handlersWithKey.ValueJSONHandler)
+	r.HandleFunc("/update/{type}/{name}/{value}", handlersWithKey.UpdateStringHandler)
+	r.HandleFunc("/value/{type}/{name}", handlersWithKey.ValueStringHandler)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, path := range []string{"/update/gauge/Foo/1.5", "/update/counter/Foo/3", "/update/gauge/Bar/2"} {
+		resp, err := http.Post(ts.URL+path, "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		statusCode int
+		expected   string
+	}{
+		{
+			name:       "gauge value",
+			path:       "/value/gauge/Foo",
+			statusCode: http.StatusOK,
+			expected:   `1.5`,
+		},
+		{
+			name:       "counter value with the same name",
+			path:       "/value/counter/Foo",
+			statusCode: http.StatusOK,
+			expected:   `3`,
+		},
+		{
+			name:       "type mismatch",
+			path:       "/value/counter/Bar",
+			statusCode: http.StatusNotFound,
+			expected:   `{"status":"missing parameter"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			respBody, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if status := resp.StatusCode; status != tt.statusCode {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, tt.statusCode)
+			}
+			if string(respBody) != tt.expected {
+				t.Errorf("handler returned unexpected body: got %v want %v",
+					string(respBody), tt.expected)
+			}
+		})
+	}
+
+	body, _ := json.Marshal(metrics.Metrics{ID: "Bar", MType: metrics.Counter})
+	resp, err := http.Post(ts.URL+"/value/", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if status := resp.StatusCode; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+
+	st := storage.NewMemStorage()
+	r := mux.NewRouter()
+	handlersWithKey := NewWrapperJSONStruct(st, "")
+	r.HandleFunc("/history/{type}/{name}", handlersWithKey.HistoryHandler)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/history/gauge/Alloc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if status := resp.StatusCode; status != http.StatusNotImplemented {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotImplemented)
+	}
+
+	st.EnableHistory()
+	for _, value := range []float64{1, 3} {
+		value := value
+		err = st.Update(context.Background(), metrics.Metrics{ID: "Alloc", MType: metrics.Gauge, Value: &value})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from := time.Now().Add(-time.Minute).Unix()
+	resp, err = http.Get(ts.URL + "/history/gauge/Alloc?step=10m&from=" + strconv.FormatInt(from, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if status := resp.StatusCode; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	var points []storage.Point
+	if err = json.NewDecoder(resp.Body).Decode(&points); err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 || *points[0].Avg != 2 || *points[0].Last != 3 {
+		t.Errorf("handler returned unexpected points: %+v", points)
+	}
+
+	resp, err = http.Get(ts.URL + "/history/gauge/Alloc?step=bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if status := resp.StatusCode; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+
+	st := storage.NewMemStorage()
+	delta := int64(5)
+	value := 0.25
+	ctx := context.Background()
+	for _, mp := range []metrics.Metrics{
+		{ID: "PollCount", MType: metrics.Counter, Delta: &delta},
+		{ID: "CPUutilization1", MType: metrics.Gauge, Value: &value},
+		{ID: "1st.value", MType: metrics.Gauge, Value: &value},
+	} {
+		if err := st.Update(ctx, mp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := mux.NewRouter()
+	handlersWithKey := NewWrapperJSONStruct(st, "")
+	r.HandleFunc("/metrics", handlersWithKey.PrometheusHandler)
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != PrometheusContentType {
+		t.Errorf("handler returned wrong content type: got %v want %v",
+			contentType, PrometheusContentType)
+	}
+	expected := "# TYPE CPUutilization1 gauge\nCPUutilization1 0.25\n" +
+		"# TYPE PollCount_total counter\nPollCount_total 5\n" +
+		"# TYPE _1st_value gauge\n_1st_value 0.25\n"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q",
+			rr.Body.String(), expected)
+	}
+}
+
+func TestListHandler(t *testing.T) {
+
+	st := storage.NewMemStorage()
+	ctx := context.Background()
+	value := 1.5
+	delta := int64(2)
+	for _, id := range []string{"Alloc", "Frees", "HeapAlloc", "HeapIdle", "HeapInuse"} {
+		if err := st.Update(ctx, metrics.Metrics{ID: id, MType: metrics.Gauge, Value: &value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.Update(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Delta: &delta}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	handlersWithKey := NewWrapperJSONStruct(st, "")
+	r.HandleFunc("/api/v1/metrics", handlersWithKey.ListHandler)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	list := func(query string) ([]string, string, int) {
+		resp, err := http.Get(ts.URL + "/api/v1/metrics?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, "", resp.StatusCode
+		}
+		var page []metrics.Metrics
+		if err = json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, mp := range page {
+			ids = append(ids, mp.ID)
+		}
+		return ids, resp.Header.Get(NextCursorHeader), resp.StatusCode
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{name: "type filter", query: "type=counter", want: []string{"PollCount"}},
+		{name: "prefix filter", query: "prefix=Heap&sort=-name", want: []string{"HeapInuse", "HeapIdle", "HeapAlloc"}},
+		{name: "regex filter", query: "match=^(Alloc|Frees)$", want: []string{"Alloc", "Frees"}},
+		{name: "type sort", query: "sort=type&limit=2", want: []string{"PollCount", "Alloc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, _, status := list(tt.query)
+			if status != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("handler returned unexpected metrics: got %v want %v", ids, tt.want)
+			}
+		})
+	}
+
+	var all []string
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		ids, next, status := list("limit=4&cursor=" + cursor)
+		if status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		all = append(all, ids...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if got := strings.Join(all, ","); got != "Alloc,Frees,HeapAlloc,HeapIdle,HeapInuse,PollCount" {
+		t.Errorf("pagination returned unexpected metrics: %s", got)
+	}
+
+	for _, query := range []string{"type=summary", "match=(", "limit=0", "sort=value", "cursor=bad", "sort=-name&cursor=" + cursor} {
+		if _, _, status := list(query); status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v", query, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGenericHandlerDashboard(t *testing.T) {
+
+	st := storage.NewMemStorage()
+	r := mux.NewRouter()
+	handlersWithKey := NewWrapperJSONStruct(st, "")
+	r.HandleFunc("/update/{type}/{name}/{value}", handlersWithKey.UpdateStringHandler)
+	r.HandleFunc("/", handlersWithKey.GenericHandler)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, path := range []string{"/update/gauge/<Alloc>/2.5", "/update/counter/PollCount/3"} {
+		resp, err := http.Post(ts.URL+path, "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := resp.StatusCode; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	page := string(body)
+	for _, want := range []string{"<td>&lt;Alloc&gt;</td>", ">2.5<", "<td>PollCount</td>", ">3<", "127.0.0.1", `http-equiv="refresh"`} {
+		if !strings.Contains(page, want) {
+			t.Errorf("dashboard does not contain %s", want)
+		}
+	}
+	if strings.Contains(page, "&mdash;") {
+		t.Errorf("dashboard misses the last update of a stored metric")
+	}
+	if strings.Contains(page, "http://") || strings.Contains(page, "https://") {
+		t.Errorf("dashboard references external resources")
+	}
+}
+
+func TestDeleteResetHandlers(t *testing.T) {
+
+	const key = "secret"
+	st := storage.NewMemStorage()
+	ctx := context.Background()
+	delta := int64(4)
+	value := 1.5
+	stored := []metrics.Metrics{
+		{ID: "PollCount", MType: metrics.Counter, Delta: &delta},
+		{ID: "Alloc", MType: metrics.Gauge, Value: &value},
+		{ID: "Frees", MType: metrics.Gauge, Value: &value},
+	}
+	err := st.UpdateBatch(ctx, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activity := events.NewActivity()
+	activity.Record(stored, "127.0.0.1", time.Now())
+
+	r := mux.NewRouter()
+	handlersWithKey := NewWrapperJSONStruct(st, key).WithActivity(activity)
+	r.HandleFunc("/value/{type}/{name}", handlersWithKey.DeleteHandler).Methods(http.MethodDelete)
+	r.HandleFunc("/deletes/", handlersWithKey.DeleteBatchJSONHandler)
+	r.HandleFunc("/reset/{type}/{name}", handlersWithKey.ResetHandler)
+
+	now := time.Now().Unix()
+	sign := func(action string, mp metrics.Metrics) string {
+		return metrics.ActionHash(action, mp, now, key)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		hash     string
+		signedAt int64
+		body     string
+		status   int
+	}{
+		{
+			name:   "unsigned delete",
+			method: http.MethodDelete,
+			path:   "/value/gauge/Alloc",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:     "signed delete",
+			method:   http.MethodDelete,
+			path:     "/value/gauge/Alloc",
+			hash:     sign(metrics.ActionDelete, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge}),
+			signedAt: now,
+			status:   http.StatusOK,
+		},
+		{
+			name:     "delete missing",
+			method:   http.MethodDelete,
+			path:     "/value/gauge/Alloc",
+			hash:     sign(metrics.ActionDelete, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge}),
+			signedAt: now,
+			status:   http.StatusNotFound,
+		},
+		{
+			name:     "delete hash replayed as reset",
+			method:   http.MethodPost,
+			path:     "/reset/counter/PollCount",
+			hash:     sign(metrics.ActionDelete, metrics.Metrics{ID: "PollCount", MType: metrics.Counter}),
+			signedAt: now,
+			status:   http.StatusBadRequest,
+		},
+		{
+			name:   "reset without signing time",
+			method: http.MethodPost,
+			path:   "/reset/counter/PollCount",
+			hash:   sign(metrics.ActionReset, metrics.Metrics{ID: "PollCount", MType: metrics.Counter}),
+			status: http.StatusBadRequest,
+		},
+		{
+			name:     "replayed reset",
+			method:   http.MethodPost,
+			path:     "/reset/counter/PollCount",
+			hash:     metrics.ActionHash(metrics.ActionReset, metrics.Metrics{ID: "PollCount", MType: metrics.Counter}, now-600, key),
+			signedAt: now - 600,
+			status:   http.StatusBadRequest,
+		},
+		{
+			name:     "signing time changed",
+			method:   http.MethodPost,
+			path:     "/reset/counter/PollCount",
+			hash:     sign(metrics.ActionReset, metrics.Metrics{ID: "PollCount", MType: metrics.Counter}),
+			signedAt: now - 1,
+			status:   http.StatusBadRequest,
+		},
+		{
+			name:     "signed reset",
+			method:   http.MethodPost,
+			path:     "/reset/counter/PollCount",
+			hash:     sign(metrics.ActionReset, metrics.Metrics{ID: "PollCount", MType: metrics.Counter}),
+			signedAt: now,
+			status:   http.StatusOK,
+		},
+		{
+			name:     "gauge reset",
+			method:   http.MethodPost,
+			path:     "/reset/gauge/Frees",
+			hash:     sign(metrics.ActionReset, metrics.Metrics{ID: "Frees", MType: metrics.Gauge}),
+			signedAt: now,
+			status:   http.StatusBadRequest,
+		},
+		{
+			name:   "batch delete",
+			method: http.MethodPost,
+			path:   "/deletes/",
+			body: `[{"id":"Frees","type":"gauge","hash":"` +
+				sign(metrics.ActionDelete, metrics.Metrics{ID: "Frees", MType: metrics.Gauge}) + `"}]`,
+			signedAt: now,
+			status:   http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.hash != "" {
+				req.Header.Set(HashHeader, tt.hash)
+			}
+			if tt.signedAt != 0 {
+				req.Header.Set(HashTimeHeader, strconv.FormatInt(tt.signedAt, 10))
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if status := rr.Code; status != tt.status {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, tt.status)
+			}
+		})
+	}
+
+	mb, err := st.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mb) != 1 || mb[0].ID != "PollCount" || *mb[0].Delta != 0 {
+		t.Errorf("unexpected metrics left after delete and reset: %+v", mb)
+	}
+	for _, mp := range stored {
+		if _, ok := activity.Get(mp); ok != (mp.ID == "PollCount") {
+			t.Errorf("activity of %s is kept %v after delete and reset, want %v", mp.ID, ok, mp.ID == "PollCount")
+		}
+	}
+}
+
+func TestHistogramHandlers(t *testing.T) {
+
+	st := storage.NewMemStorage()
+	r := mux.NewRouter()
+	handlersWithKey := NewWrapperJSONStruct(st, "secret")
+	r.HandleFunc("/update/", handlersWithKey.UpdateJSONHandler)
+	r.HandleFunc("/value/", handlersWithKey.ValueJSONHandler)
+	r.HandleFunc("/metrics", handlersWithKey.PrometheusHandler)
+
+	observed := metrics.Metrics{ID: "Latency", MType: metrics.Histogram, Histogram: &metrics.HistogramValue{
+		Count: 3, Sum: 0.9, Bounds: []float64{0.1, 0.5}, Buckets: []uint64{1, 1, 1},
+	}}
+	mismatched := metrics.Metrics{ID: "Latency", MType: metrics.Histogram, Histogram: &metrics.HistogramValue{
+		Count: 1, Sum: 0.2, Bounds: []float64{1}, Buckets: []uint64{1, 0},
+	}}
+	unsigned := observed
+
+	tests := []struct {
+		name   string
+		mp     metrics.Metrics
+		sign   bool
+		status int
+	}{
+		{name: "signed histogram", mp: observed, sign: true, status: http.StatusOK},
+		{name: "second report", mp: observed, sign: true, status: http.StatusOK},
+		{name: "unsigned histogram", mp: unsigned, status: http.StatusBadRequest},
+		{name: "bucket mismatch", mp: mismatched, sign: true, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.sign {
+				tt.mp.Hash = metrics.MetricsHash(tt.mp, "secret")
+			}
+			body, _ := json.Marshal(tt.mp)
+			rr := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodPost, "/update/", bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.ServeHTTP(rr, req)
+			if status := rr.Code; status != tt.status {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, tt.status)
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/value/", bytes.NewBufferString(`{"id":"Latency","type":"histogram"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ServeHTTP(rr, req)
+	var retrieved metrics.Metrics
+	if err = json.NewDecoder(rr.Body).Decode(&retrieved); err != nil {
+		t.Fatal(err)
+	}
+	if retrieved.Histogram == nil || retrieved.Histogram.Count != 6 || retrieved.Hash != metrics.MetricsHash(retrieved, "secret") {
+		t.Errorf("handler returned unexpected histogram: %+v", retrieved)
+	}
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ServeHTTP(rr, req)
+	expected := "# TYPE Latency histogram\n" +
+		"Latency_bucket{le=\"0.1\"} 2\nLatency_bucket{le=\"0.5\"} 4\nLatency_bucket{le=\"+Inf\"} 6\n" +
+		"Latency_sum 1.8\nLatency_count 6\n"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", rr.Body.String(), expected)
+	}
+}
+
+func TestLabels(t *testing.T) {
+
+	st := storage.NewMemStorage()
+	r := mux.NewRouter()
+	handlersWithKey := NewWrapperJSONStruct(st, "")
+	r.HandleFunc("/update/", handlersWithKey.UpdateJSONHandler)
+	r.HandleFunc("/update/{type}/{name}/{value}", handlersWithKey.UpdateStringHandler)
+	r.HandleFunc("/value/{type}/{name}", handlersWithKey.ValueStringHandler)
+	r.HandleFunc("/api/v1/metrics", handlersWithKey.ListHandler)
+	r.HandleFunc("/metrics", handlersWithKey.PrometheusHandler)
+
+	do := func(method, path, body string) (int, string) {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.ServeHTTP(rr, req)
+		return rr.Code, rr.Body.String()
+	}
+
+	updates := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{method: http.MethodPost, path: "/update/", body: `{"id":"Alloc","type":"gauge","value":1,"labels":{"host":"a"}}`},
+		{method: http.MethodPost, path: "/update/gauge/Alloc/2?label=host=b"},
+		{method: http.MethodPost, path: "/update/gauge/Alloc/3"},
+		{method: http.MethodPost, path: "/update/counter/PollCount/4?label=host=b"},
+	}
+	for _, u := range updates {
+		if status, body := do(u.method, u.path, u.body); status != http.StatusOK {
+			t.Fatalf("update %s returned %v: %s", u.path, status, body)
+		}
+	}
+
+	if status, body := do(http.MethodGet, "/value/gauge/Alloc?label=host=b", ""); status != http.StatusOK || body != "2" {
+		t.Errorf("handler returned unexpected value: %v %s", status, body)
+	}
+	if status, body := do(http.MethodGet, "/value/gauge/Alloc", ""); status != http.StatusOK || body != "3" {
+		t.Errorf("handler returned unexpected value: %v %s", status, body)
+	}
+	if status, _ := do(http.MethodGet, "/value/gauge/Alloc?label=host=c", ""); status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+	if status, _ := do(http.MethodGet, "/value/gauge/Alloc?label=1host=c", ""); status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "label=host=b", want: []string{`Alloc{host="b"}`, `PollCount{host="b"}`}},
+		{query: "label=host!=b&type=gauge", want: []string{"Alloc", `Alloc{host="a"}`}},
+		{query: "label=host=~a|b&prefix=Alloc", want: []string{`Alloc{host="a"}`, `Alloc{host="b"}`}},
+		{query: "label=host!~.%2B", want: []string{"Alloc"}},
+	}
+	for _, tt := range tests {
+		status, body := do(http.MethodGet, "/api/v1/metrics?"+tt.query, "")
+		if status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code for %s: got %v", tt.query, status)
+		}
+		var page []metrics.Metrics
+		if err := json.Unmarshal([]byte(body), &page); err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, mp := range page {
+			keys = append(keys, metrics.SeriesKey(mp))
+		}
+		if strings.Join(keys, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("handler returned unexpected metrics for %s: got %v want %v", tt.query, keys, tt.want)
+		}
+	}
+
+	_, body := do(http.MethodGet, "/metrics", "")
+	expected := "# TYPE Alloc gauge\nAlloc 3\nAlloc{host=\"a\"} 1\nAlloc{host=\"b\"} 2\n" +
+		"# TYPE PollCount_total counter\nPollCount_total{host=\"b\"} 4\n"
+	if body != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", body, expected)
+	}
+}
+
+func TestAgentsHandler(t *testing.T) {
+
+	st := storage.NewMemStorage()
+	r := mux.NewRouter()
+	handlersWithKey := NewWrapperJSONStruct(st, "")
+	r.HandleFunc("/updates/", handlersWithKey.UpdateBatchJSONHandler)
+	r.HandleFunc("/api/v1/agents", handlersWithKey.AgentsHandler)
+
+	body := `[{"id":"Alloc","type":"gauge","value":1,"labels":{"instance":"b"}},` +
+		`{"id":"PollCount","type":"counter","delta":2,"labels":{"instance":"b"}},` +
+		`{"id":"Alloc","type":"gauge","value":3,"labels":{"instance":"a"}},` +
+		`{"id":"Alloc","type":"gauge","value":4}]`
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("batch update returned %v: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/api/v1/agents", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var agents []AgentInfo
+	if err = json.NewDecoder(rr.Body).Decode(&agents); err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 2 || agents[0].ID != "a" || agents[1].ID != "b" {
+		t.Fatalf("handler returned unexpected agents: %+v", agents)
+	}
+	if agents[0].Metrics != 1 || agents[1].Metrics != 2 {
+		t.Errorf("handler returned unexpected metric counts: %+v", agents)
+	}
+	for _, agent := range agents {
+		if agent.LastSeen == nil {
+			t.Errorf("agent %s has no last seen time", agent.ID)
+		}
+	}
+}
+
+func TestValueUnlabeledLookup(t *testing.T) {
+
+	st := storage.NewMemStorage()
+	r := mux.NewRouter()
+	handlersWithKey := NewWrapperJSONStruct(st, "")
+	r.HandleFunc("/update/", handlersWithKey.UpdateJSONHandler)
+	r.HandleFunc("/value/", handlersWithKey.ValueJSONHandler)
+	r.HandleFunc("/value/{type}/{name}", handlersWithKey.ValueStringHandler)
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the agent attaches its instance label, the clients query the value without labels
+	rr := serve(http.MethodPost, "/update/", `{"id":"Alloc","type":"gauge","value":1.5,"labels":{"instance":"host-a"}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("update returned %v: %s", rr.Code, rr.Body.String())
+	}
+	rr = serve(http.MethodGet, "/value/gauge/Alloc", "")
+	if rr.Code != http.StatusOK || rr.Body.String() != "1.5" {
+		t.Errorf("unlabeled value returned %v: %s", rr.Code, rr.Body.String())
+	}
+	rr = serve(http.MethodPost, "/value/", `{"id":"Alloc","type":"gauge"}`)
+	var mp metrics.Metrics
+	if err := json.NewDecoder(rr.Body).Decode(&mp); err != nil || rr.Code != http.StatusOK || mp.Value == nil || *mp.Value != 1.5 {
+		t.Errorf("unlabeled json value returned %v: %+v", rr.Code, mp)
+	}
+	if mp.Labels[metrics.InstanceLabel] != "host-a" {
+		t.Errorf("resolved metric has labels %v", mp.Labels)
+	}
+
+	// with a second agent the unlabeled lookup is ambiguous, the labeled one still works
+	rr = serve(http.MethodPost, "/update/", `{"id":"Alloc","type":"gauge","value":2.5,"labels":{"instance":"host-b"}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("update returned %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr = serve(http.MethodGet, "/value/gauge/Alloc", ""); rr.Code != http.StatusConflict {
+		t.Errorf("ambiguous value returned %v, want %v", rr.Code, http.StatusConflict)
+	}
+	if rr = serve(http.MethodPost, "/value/", `{"id":"Alloc","type":"gauge"}`); rr.Code != http.StatusConflict {
+		t.Errorf("ambiguous json value returned %v, want %v", rr.Code, http.StatusConflict)
+	}
+	if rr = serve(http.MethodPost, "/value/", `{"id":"Alloc","type":"gauge","labels":{"instance":"host-b"}}`); rr.Code != http.StatusOK {
+		t.Errorf("labeled json value returned %v", rr.Code)
+	}
+	if rr = serve(http.MethodGet, "/value/gauge/Missing", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("missing value returned %v, want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestListAgentsLastSeen(t *testing.T) {
+
+	value := 1.0
+	older, newer := time.Now().Add(-time.Minute), time.Now()
+	agents := listAgents([]metrics.Metrics{
+		{ID: "Alloc", MType: metrics.Gauge, Value: &value, Labels: map[string]string{metrics.InstanceLabel: "a"}, Updated: &older},
+		{ID: "Sys", MType: metrics.Gauge, Value: &value, Labels: map[string]string{metrics.InstanceLabel: "a"}, Updated: &newer},
+	})
+	if len(agents) != 1 || agents[0].LastSeen == nil || !agents[0].LastSeen.Equal(newer) {
+		t.Errorf("listAgents returned %+v, want last seen %v", agents, newer)
+	}
+}
+
+func TestStaleMetrics(t *testing.T) {
+
+	st := storage.NewMemStorage()
+	value := 1.5
+	delta := int64(2)
+	if err := st.UpdateBatch(context.Background(), []metrics.Metrics{
+		{ID: "Alloc", MType: metrics.Gauge, Value: &value},
+		{ID: "PollCount", MType: metrics.Counter, Delta: &delta},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		wantStale bool
+		wantList  int
+	}{
+		{name: "stale gauge", ttl: time.Nanosecond, wantStale: true, wantList: 1},
+		{name: "fresh gauge", ttl: time.Hour, wantStale: false, wantList: 0},
+		{name: "detection disabled", ttl: 0, wantStale: false, wantList: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mux.NewRouter()
+			handlersWithKey := NewWrapperJSONStruct(st, "").WithStaleTTL(tt.ttl)
+			r.HandleFunc("/value/", handlersWithKey.ValueJSONHandler)
+			r.HandleFunc("/value/{type}/{name}", handlersWithKey.ValueStringHandler)
+			r.HandleFunc("/api/v1/metrics", handlersWithKey.ListHandler)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/value/", strings.NewReader(`{"id":"Alloc","type":"gauge"}`))
+			r.ServeHTTP(rr, req)
+			var mp metrics.Metrics
+			if err := json.NewDecoder(rr.Body).Decode(&mp); err != nil {
+				t.Fatal(err)
+			}
+			if mp.Stale != tt.wantStale || mp.Updated == nil {
+				t.Errorf("value handler returned stale %v, updated %v", mp.Stale, mp.Updated)
+			}
+
+			rr = httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/value/gauge/Alloc", nil))
+			if got := rr.Header().Get(StaleHeader) == "true"; got != tt.wantStale {
+				t.Errorf("value handler returned stale header %v, want %v", got, tt.wantStale)
+			}
+
+			rr = httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/metrics?stale=true", nil))
+			var list []metrics.Metrics
+			if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != tt.wantList {
+				t.Errorf("list handler returned %d stale metrics, want %d", len(list), tt.wantList)
+			}
+		})
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+
+	st := storage.NewMemStorage()
+	r := mux.NewRouter()
+	handlersWithKey := NewWrapperJSONStruct(st, "")
+	r.HandleFunc("/update/{type}/{name}/{value}", handlersWithKey.UpdateStringHandler)
+	r.HandleFunc("/api/v1/stream", handlersWithKey.StreamHandler)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/v1/stream?type=gauge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("handler returned wrong content type: %s", resp.Header.Get("Content-Type"))
+	}
+
+	for _, path := range []string{"/update/counter/PollCount/1", "/update/gauge/Alloc/2.5"} {
+		update, err := http.Post(ts.URL+path, "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		update.Body.Close()
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	var event []string
+	for len(event) < 2 {
+		select {
+		case line := <-lines:
+			if line != "" {
+				event = append(event, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no update received, got %q", event)
+		}
+	}
+	if event[0] != "event: update" {
+		t.Fatalf("handler returned unexpected event: %q", event)
+	}
+	var mp metrics.Metrics
+	if err = json.Unmarshal([]byte(strings.TrimPrefix(event[1], "data: ")), &mp); err != nil {
+		t.Fatal(err)
+	}
+	if mp.ID != "Alloc" || mp.Value == nil || *mp.Value != 2.5 || mp.Updated == nil {
+		t.Errorf("handler returned unexpected update: %+v", mp)
+	}
+}
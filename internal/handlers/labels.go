@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+// LabelParam is the query parameter carrying the labels of the url-encoded requests, e.g. ?label=host=a&label=zone=eu.
+const LabelParam = "label"
+
+// labelMatcher struct selects metrics by a label value. Metrics without the label are matched as having an empty value.
+type labelMatcher struct {
+	name   string
+	value  string
+	re     *regexp.Regexp
+	negate bool
+}
+
+// requestLabels function reads the exact labels of a single system metric from the query parameters.
+func requestLabels(r *http.Request) (map[string]string, error) {
+
+	params := r.URL.Query()[LabelParam]
+	if len(params) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(params))
+	for _, param := range params {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok || !metrics.ValidLabelName(name) {
+			return nil, fmt.Errorf("%w: %q", metrics.ErrInvalidLabels, param)
+		}
+		if _, ok = labels[name]; ok {
+			return nil, fmt.Errorf("%w: duplicate label %s", metrics.ErrInvalidLabels, name)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// parseLabelMatcher function parses a label matcher written as name=value, name!=value, name=~regexp or name!~regexp.
+// Regular expressions must match the whole label value.
+func parseLabelMatcher(param string) (labelMatcher, error) {
+
+	var m labelMatcher
+	i := strings.IndexAny(param, "=!")
+	if i < 0 || !metrics.ValidLabelName(param[:i]) {
+		return m, fmt.Errorf("%w: %q", metrics.ErrInvalidLabels, param)
+	}
+	m.name = param[:i]
+	rest := param[i:]
+	var op string
+	for _, candidate := range []string{"!=", "=~", "!~", "="} {
+		if strings.HasPrefix(rest, candidate) {
+			op, m.value = candidate, rest[len(candidate):]
+			break
+		}
+	}
+	switch op {
+	case "":
+		return m, fmt.Errorf("%w: %q", metrics.ErrInvalidLabels, param)
+	case "=~", "!~":
+		re, err := regexp.Compile("^(?:" + m.value + ")$")
+		if err != nil {
+			return m, err
+		}
+		m.re = re
+	}
+	m.negate = op == "!=" || op == "!~"
+	return m, nil
+}
+
+// matches function reports whether the labels satisfy the matcher.
+func (m labelMatcher) matches(labels map[string]string) bool {
+
+	value := labels[m.name]
+	if m.re != nil {
+		return m.re.MatchString(value) != m.negate
+	}
+	return (value == m.value) != m.negate
+}
@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/config"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+// Defaults and limits of the metrics list pagination.
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// NextCursorHeader is the response header carrying the cursor of the next metrics list page.
+const NextCursorHeader = "X-Next-Cursor"
+
+// listQuery struct holds the parsed parameters of the metrics list request.
+type listQuery struct {
+	mtype    string
+	prefix   string
+	re       *regexp.Regexp
+	matchers []labelMatcher
+	stale    *bool
+	sortBy   string
+	desc     bool
+	limit    int
+	after    *listCursor
+}
+
+// listCursor struct identifies the last metric of the returned page, the next page starts right after it.
+type listCursor struct {
+	Sort   string `json:"sort"`
+	ID     string `json:"id"`
+	MType  string `json:"type"`
+	Labels string `json:"labels,omitempty"`
+}
+
+// ListHandler returns the stored system metrics filtered by type and name, sorted and split into pages.
+//
+// Query parameters: type (gauge, counter or histogram), prefix, match (regular expression on the name),
+// label matchers (label=host=a, label=host!=a, label=host=~a.* or label=host!~a.*, all of them must match),
+// stale (true or false, selects the metrics by the stale flag), sort (name or type, prefixed with - for descending order),
+// limit and cursor.
+// The cursor of the next page is returned in the X-Next-Cursor header, it is empty on the last page.
+func (ws WrapperJSONStruct) ListHandler(rw http.ResponseWriter, r *http.Request) {
+
+	resp := make(map[string]string)
+	rw.Header().Set("Content-Type", "application/json")
+
+	q, err := parseListQuery(r)
+	if err != nil {
+		log.Printf("Error happened in parsing list parameters. Err: %s", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		resp["status"] = "wrong list parameters"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	metricsList, err := ws.st.List(ctx)
+	if err != nil {
+		log.Printf("Error happened in retrieving metrics. Err: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		resp["status"] = "list retrieval failed"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+
+	now := time.Now()
+	for i := range metricsList {
+		ws.markStale(&metricsList[i], now)
+	}
+	page, next := q.apply(metricsList)
+	if ws.key != "" {
+		for i := range page {
+			page[i].Hash = metrics.MetricsHash(page[i], ws.key)
+		}
+	}
+	if next != nil {
+		rw.Header().Set(NextCursorHeader, encodeCursor(*next))
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(page)
+}
+
+// parseListQuery function reads and validates the query parameters of the metrics list request.
+func parseListQuery(r *http.Request) (listQuery, error) {
+
+	query := r.URL.Query()
+	q := listQuery{
+		mtype:  query.Get("type"),
+		prefix: query.Get("prefix"),
+		sortBy: "name",
+		limit:  DefaultListLimit,
+	}
+
+	if q.mtype != "" && !metrics.ValidType(q.mtype) {
+		return q, errors.New("invalid type")
+	}
+	if value := query.Get("match"); value != "" {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return q, err
+		}
+		q.re = re
+	}
+	for _, param := range query[LabelParam] {
+		m, err := parseLabelMatcher(param)
+		if err != nil {
+			return q, err
+		}
+		q.matchers = append(q.matchers, m)
+	}
+	if value := query.Get("stale"); value != "" {
+		stale, err := strconv.ParseBool(value)
+		if err != nil {
+			return q, err
+		}
+		q.stale = &stale
+	}
+	if value := query.Get("sort"); value != "" {
+		q.desc = strings.HasPrefix(value, "-")
+		q.sortBy = strings.TrimPrefix(value, "-")
+		if q.sortBy != "name" && q.sortBy != "type" {
+			return q, errors.New("invalid sort field")
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return q, err
+		}
+		if limit <= 0 || limit > MaxListLimit {
+			return q, errors.New("limit out of range")
+		}
+		q.limit = limit
+	}
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := decodeCursor(value)
+		if err != nil {
+			return q, err
+		}
+		if cursor.Sort != q.sortKey() {
+			return q, errors.New("cursor belongs to a different sort order")
+		}
+		q.after = &cursor
+	}
+	return q, nil
+}
+
+// apply function filters and sorts the system metrics and returns the requested page
+// together with the cursor of the next one, which is nil on the last page.
+func (q listQuery) apply(metricsList []metrics.Metrics) ([]metrics.Metrics, *listCursor) {
+
+	filtered := make([]metrics.Metrics, 0, len(metricsList))
+	for _, mp := range metricsList {
+		if q.mtype != "" && mp.MType != q.mtype {
+			continue
+		}
+		if !strings.HasPrefix(mp.ID, q.prefix) {
+			continue
+		}
+		if q.re != nil && !q.re.MatchString(mp.ID) {
+			continue
+		}
+		if !q.matchLabels(mp) {
+			continue
+		}
+		if q.stale != nil && mp.Stale != *q.stale {
+			continue
+		}
+		if q.after != nil && !q.less(*q.after, mp) {
+			continue
+		}
+		filtered = append(filtered, mp)
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		return q.less(cursorOf(filtered[i]), filtered[j])
+	})
+
+	if len(filtered) <= q.limit {
+		return filtered, nil
+	}
+	page := filtered[:q.limit]
+	next := cursorOf(page[len(page)-1])
+	next.Sort = q.sortKey()
+	return page, &next
+}
+
+// matchLabels function reports whether the labels of the metric satisfy all the label matchers.
+func (q listQuery) matchLabels(mp metrics.Metrics) bool {
+
+	for _, m := range q.matchers {
+		if !m.matches(mp.Labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// less function reports whether the metric identified by the cursor goes before the metric in the requested order.
+// Metrics with the same name and type are ordered by their labels.
+func (q listQuery) less(c listCursor, mp metrics.Metrics) bool {
+
+	labels := metrics.LabelsString(mp.Labels)
+	first, second := [3]string{c.ID, c.MType, c.Labels}, [3]string{mp.ID, mp.MType, labels}
+	if q.sortBy == "type" {
+		first, second = [3]string{c.MType, c.ID, c.Labels}, [3]string{mp.MType, mp.ID, labels}
+	}
+	if q.desc {
+		first, second = second, first
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			return first[i] < second[i]
+		}
+	}
+	return false
+}
+
+// cursorOf function returns the cursor identifying the metric.
+func cursorOf(mp metrics.Metrics) listCursor {
+
+	return listCursor{ID: mp.ID, MType: mp.MType, Labels: metrics.LabelsString(mp.Labels)}
+}
+
+// sortKey function returns the sort order stored in the cursor, so the cursor is not reused with another order.
+func (q listQuery) sortKey() string {
+
+	if q.desc {
+		return "-" + q.sortBy
+	}
+	return q.sortBy
+}
+
+// encodeCursor function returns the opaque url-safe representation of the cursor.
+func encodeCursor(c listCursor) string {
+
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor function parses the cursor received in the metrics list request.
+func decodeCursor(value string) (listCursor, error) {
+
+	var c listCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/config"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+// PrometheusContentType is the content type of the Prometheus text exposition format.
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// PrometheusHandler returns all the stored system metrics in the Prometheus text exposition format.
+func (ws WrapperJSONStruct) PrometheusHandler(rw http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	metricsList, err := ws.st.List(ctx)
+	if err != nil {
+		log.Printf("Error happened in retrieving metrics. Err: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	WritePrometheus(&buf, metricsList)
+
+	rw.Header().Set("Content-Type", PrometheusContentType)
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf.Bytes())
+}
+
+// WritePrometheus function renders the system metrics in the Prometheus text exposition format.
+// Metric names are sanitized, counters get the _total suffix so that a gauge and a counter
+// with the same ID do not collide. Histograms are rendered with cumulative buckets.
+// Metrics with labels are rendered as series of the metric family named after their ID.
+// Metrics whose sanitized names clash with an earlier family of another type or series are skipped.
+func WritePrometheus(w io.Writer, metricsList []metrics.Metrics) {
+
+	type series struct {
+		family string
+		labels string
+		mp     metrics.Metrics
+	}
+	list := make([]series, 0, len(metricsList))
+	for _, mp := range metricsList {
+		switch {
+		case mp.MType == metrics.Counter && mp.Delta != nil:
+			list = append(list, series{family: PrometheusName(mp.ID) + "_total", mp: mp})
+		case mp.MType == metrics.Gauge && mp.Value != nil,
+			mp.MType == metrics.Histogram && mp.Histogram != nil:
+			list = append(list, series{family: PrometheusName(mp.ID), mp: mp})
+		default:
+			continue
+		}
+		list[len(list)-1].labels = metrics.LabelsString(mp.Labels)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].family != list[j].family {
+			return list[i].family < list[j].family
+		}
+		if list[i].mp.MType != list[j].mp.MType {
+			return list[i].mp.MType < list[j].mp.MType
+		}
+		if list[i].labels != list[j].labels {
+			return list[i].labels < list[j].labels
+		}
+		return list[i].mp.ID < list[j].mp.ID
+	})
+
+	families := make(map[string]string)
+	seen := make(map[string]bool)
+	for _, s := range list {
+		mp := s.mp
+		if mtype, ok := families[s.family]; (ok && mtype != mp.MType) || seen[s.family+"{"+s.labels+"}"] {
+			log.Printf("Skipping metric %s of type %s: name %s is already exported", metrics.SeriesKey(mp), mp.MType, s.family)
+			continue
+		}
+		seen[s.family+"{"+s.labels+"}"] = true
+		if _, ok := families[s.family]; !ok {
+			families[s.family] = mp.MType
+			fmt.Fprintf(w, "# TYPE %s %s\n", s.family, mp.MType)
+		}
+
+		switch mp.MType {
+		case metrics.Counter:
+			fmt.Fprintf(w, "%s%s %d\n", s.family, prometheusLabels(mp.Labels, ""), *mp.Delta)
+		case metrics.Gauge:
+			fmt.Fprintf(w, "%s%s %s\n", s.family, prometheusLabels(mp.Labels, ""), prometheusFloat(*mp.Value))
+		case metrics.Histogram:
+			writePrometheusHistogram(w, s.family, mp.Labels, mp.Histogram)
+		}
+	}
+}
+
+// writePrometheusHistogram function renders the cumulative buckets, the sum and the count of the histogram.
+func writePrometheusHistogram(w io.Writer, name string, labels map[string]string, h *metrics.HistogramValue) {
+
+	var cumulative uint64
+	for i, n := range h.Buckets {
+		cumulative += n
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = prometheusFloat(h.Bounds[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, prometheusLabels(labels, le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, prometheusLabels(labels, ""), prometheusFloat(h.Sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, prometheusLabels(labels, ""), h.Count)
+}
+
+// prometheusLabels function renders the label set of a sample, the le label is added to the histogram buckets.
+func prometheusLabels(labels map[string]string, le string) string {
+
+	if le != "" {
+		withLe := make(map[string]string, len(labels)+1)
+		for name, value := range labels {
+			withLe[name] = value
+		}
+		withLe[metrics.BucketLabel] = le
+		labels = withLe
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + metrics.LabelsString(labels) + "}"
+}
+
+// PrometheusName function converts a metric ID to a valid Prometheus metric name.
+// Characters outside [a-zA-Z0-9_:] are replaced with underscores and a leading digit is prefixed with one.
+func PrometheusName(id string) string {
+
+	var b strings.Builder
+	for i, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+			b.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(c)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// prometheusFloat function formats a gauge value, including the special values, for the exposition format.
+func prometheusFloat(v float64) string {
+
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
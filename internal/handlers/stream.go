@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+// StreamHeartbeat is the interval of the keep-alive comments sent to the idle stream subscribers.
+const StreamHeartbeat = 15 * time.Second
+
+// streamFilter struct selects the updates delivered to the subscriber by type, name and labels.
+type streamFilter struct {
+	mtype    string
+	name     string
+	matchers []labelMatcher
+}
+
+// matches function reports whether the update is selected by the filter.
+func (f streamFilter) matches(mp metrics.Metrics) bool {
+
+	if f.mtype != "" && mp.MType != f.mtype {
+		return false
+	}
+	if f.name != "" && mp.ID != f.name {
+		return false
+	}
+	for _, m := range f.matchers {
+		if !m.matches(mp.Labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseStreamFilter function reads the filter of the stream request from the query parameters.
+func parseStreamFilter(r *http.Request) (streamFilter, error) {
+
+	query := r.URL.Query()
+	f := streamFilter{mtype: query.Get("type"), name: query.Get("name")}
+	if f.mtype != "" && !metrics.ValidType(f.mtype) {
+		return f, errors.New("invalid type")
+	}
+	for _, param := range query[LabelParam] {
+		m, err := parseLabelMatcher(param)
+		if err != nil {
+			return f, err
+		}
+		f.matchers = append(f.matchers, m)
+	}
+	return f, nil
+}
+
+// StreamHandler pushes the accepted system metrics updates to the client as Server-Sent Events.
+//
+// Query parameters: type, name and label matchers (label=host=a, label=host!=a, label=host=~a.* or label=host!~a.*).
+// Every update is sent as an update event with the received metric in json, counters carry the received delta.
+// The number of updates dropped because the client did not keep up is sent as a dropped event before the next update.
+func (ws WrapperJSONStruct) StreamHandler(rw http.ResponseWriter, r *http.Request) {
+
+	resp := make(map[string]string)
+
+	filter, err := parseStreamFilter(r)
+	if err != nil {
+		log.Printf("Error happened in parsing stream parameters. Err: %s", err)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusBadRequest)
+		resp["status"] = "wrong stream parameters"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusInternalServerError)
+		resp["status"] = "streaming unsupported"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+
+	sub := ws.broker.Subscribe(filter.matches)
+	defer ws.broker.Unsubscribe(sub)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ws.broker.Done():
+			return
+		case <-heartbeat.C:
+			if _, err = fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case mp := <-sub.Updates():
+			if dropped := sub.Dropped(); dropped > 0 {
+				fmt.Fprintf(rw, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+			}
+			data, err := json.Marshal(mp)
+			if err != nil {
+				log.Printf("Error happened in JSON marshal. Err: %s", err)
+				continue
+			}
+			if _, err = fmt.Fprintf(rw, "event: update\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
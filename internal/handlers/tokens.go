@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/auth"
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/config"
+	"github.com/gorilla/mux"
+)
+
+// TokenRequest struct is the body of the token creation request.
+// The token with the instance writes only the metrics labeled with that agent instance.
+type TokenRequest struct {
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	Instance string   `json:"instance,omitempty"`
+}
+
+// TokenInfo struct describes an issued token. The secret is returned only once, when the token is created.
+type TokenInfo struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Scopes   []string  `json:"scopes"`
+	Instance string    `json:"instance,omitempty"`
+	Created  time.Time `json:"created"`
+	Token    string    `json:"token,omitempty"`
+}
+
+// WithTokens function returns a copy of WrapperJSONStruct managing the tokens of the store.
+func (ws WrapperJSONStruct) WithTokens(tokens auth.Store) WrapperJSONStruct {
+
+	ws.tokens = tokens
+	return ws
+}
+
+// CreateTokenHandler issues a token with the requested name, scopes and instance and returns it together with its secret.
+func (ws WrapperJSONStruct) CreateTokenHandler(rw http.ResponseWriter, r *http.Request) {
+
+	resp := make(map[string]string)
+	rw.Header().Set("Content-Type", "application/json")
+	var req TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		resp["status"] = "error when decoding token request"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+	token, secret, err := auth.NewToken(req.Name, req.Scopes)
+	if err != nil {
+		log.Printf("Error happened in creating token. Err: %s", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		resp["status"] = err.Error()
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+	token.Instance = req.Instance
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	if err = ws.tokens.Create(ctx, token); err != nil {
+		log.Printf("Error happened in saving token. Err: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		resp["status"] = "token creation failed"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+	log.Printf("Token %s issued to %s with scopes %v and instance %q", token.ID, token.Name, token.Scopes, token.Instance)
+
+	info := tokenInfo(token)
+	info.Token = secret
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(info)
+}
+
+// ListTokensHandler returns the issued tokens without their secrets.
+func (ws WrapperJSONStruct) ListTokensHandler(rw http.ResponseWriter, r *http.Request) {
+
+	resp := make(map[string]string)
+	rw.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	tokens, err := ws.tokens.List(ctx)
+	if err != nil {
+		log.Printf("Error happened in retrieving tokens. Err: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		resp["status"] = "token list retrieval failed"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+	infos := make([]TokenInfo, 0, len(tokens))
+	for _, t := range tokens {
+		infos = append(infos, tokenInfo(t))
+	}
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(infos)
+}
+
+// RevokeTokenHandler removes the token by its ID, the requests with the token are rejected right away.
+func (ws WrapperJSONStruct) RevokeTokenHandler(rw http.ResponseWriter, r *http.Request) {
+
+	resp := make(map[string]string)
+	rw.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.ContextDBTimeout*time.Second)
+	// не забываем освободить ресурс
+	defer cancel()
+
+	err := ws.tokens.Revoke(ctx, id)
+	if errors.Is(err, auth.ErrTokenNotFound) {
+		rw.WriteHeader(http.StatusNotFound)
+		resp["status"] = "token not found"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+	if err != nil {
+		log.Printf("Error happened in revoking token. Err: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		resp["status"] = "token revocation failed"
+		jsonResp, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Error happened in JSON marshal. Err: %s", err)
+			return
+		}
+		rw.Write(jsonResp)
+		return
+	}
+	log.Printf("Token %s revoked", id)
+	rw.WriteHeader(http.StatusOK)
+	resp["status"] = "ok"
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", err)
+		return
+	}
+	rw.Write(jsonResp)
+}
+
+// tokenInfo function returns the description of the token without its secret hash.
+func tokenInfo(t auth.Token) TokenInfo {
+
+	return TokenInfo{ID: t.ID, Name: t.Name, Scopes: t.Scopes, Instance: t.Instance, Created: t.Created}
+}
@@ -4,8 +4,10 @@
 package httpp
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
@@ -17,15 +19,55 @@ type GzipWriter struct {
 	Writer io.Writer
 }
 
-// Write function for the GzipWriter struct. 
+// Write function for the GzipWriter struct.
 func (w GzipWriter) Write(b []byte) (int, error) {
 	// w.Writer будет отвечать за gzip-сжатие, поэтому пишем в него
 	return w.Writer.Write(b)
 }
 
+// Flush function for the GzipWriter struct sends the compressed data written so far to the client,
+// so the streamed responses are delivered without waiting for the handler to return.
+func (w GzipWriter) Flush() {
+	if f, ok := w.Writer.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // Hash function is used for hashing values with the sha256 algorythm.
 func Hash(value, key string) (string, error) {
 	mac := hmac.New(sha256.New, []byte(key))
 	_, err := mac.Write([]byte(value))
 	return fmt.Sprintf("%x", mac.Sum(nil)), err
 }
+
+// BodyHash function returns the hex-encoded HMAC-SHA256 of the whole request or response body.
+func BodyHash(body []byte, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HashWriter struct is a wrapper for the http.ResponseWriter that holds the response until its body is hashed.
+type HashWriter struct {
+	http.ResponseWriter
+	Status int
+	Body   bytes.Buffer
+}
+
+// WriteHeader function for the HashWriter struct remembers the status code.
+func (w *HashWriter) WriteHeader(status int) {
+	if w.Status == 0 {
+		w.Status = status
+	}
+}
+
+// Write function for the HashWriter struct.
+func (w *HashWriter) Write(b []byte) (int, error) {
+	if w.Status == 0 {
+		w.Status = http.StatusOK
+	}
+	return w.Body.Write(b)
+}
@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// InstanceLabel is the label attached by the agent to every reported metric to identify the reporting instance.
+const InstanceLabel = "instance"
+
+// BucketLabel is the label holding the upper bound of the histogram bucket in the Prometheus text format.
+// It is reserved and cannot be set on the histogram metrics.
+const BucketLabel = "le"
+
+// ErrInvalidLabels is returned when the labels of a system metric cannot be parsed or have invalid names.
+var ErrInvalidLabels = errors.New("invalid metrics labels")
+
+// ValidLabelName function reports whether the label name matches [a-zA-Z_][a-zA-Z0-9_]*.
+func ValidLabelName(name string) bool {
+
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ValidName function reports whether the metric name can be told apart from the labels in SeriesKey:
+// it is not empty and has no curly braces or control characters.
+func ValidName(name string) bool {
+
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c == '{' || c == '}' || unicode.IsControl(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// LabelsString function returns the canonical representation of the labels sorted by name, e.g. host="a",zone="b".
+// Backslashes, double quotes and line feeds in the values are escaped the same way as in the Prometheus text format.
+func LabelsString(labels map[string]string) string {
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(labels[name]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ParseLabels function parses the canonical representation of the labels produced by LabelsString.
+// An empty string is parsed to nil labels.
+func ParseLabels(s string) (map[string]string, error) {
+
+	if s == "" {
+		return nil, nil
+	}
+	labels := make(map[string]string)
+	for len(s) > 0 {
+		name, rest, ok := strings.Cut(s, `="`)
+		if !ok || !ValidLabelName(name) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidLabels, s)
+		}
+		var value strings.Builder
+		closed := false
+		i := 0
+		for ; i < len(rest) && !closed; i++ {
+			switch c := rest[i]; c {
+			case '\\':
+				if i+1 == len(rest) {
+					return nil, fmt.Errorf("%w: unterminated escape", ErrInvalidLabels)
+				}
+				i++
+				if rest[i] == 'n' {
+					value.WriteByte('\n')
+				} else {
+					value.WriteByte(rest[i])
+				}
+			case '"':
+				closed = true
+			default:
+				value.WriteByte(c)
+			}
+		}
+		if !closed {
+			return nil, fmt.Errorf("%w: unterminated value of %s", ErrInvalidLabels, name)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("%w: duplicate label %s", ErrInvalidLabels, name)
+		}
+		labels[name] = value.String()
+
+		s = rest[i:]
+		if s != "" {
+			if s[0] != ',' || len(s) == 1 {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidLabels, s)
+			}
+			s = s[1:]
+		}
+	}
+	return labels, nil
+}
+
+// SeriesKey function returns the identity of the system metric made of its name and labels, e.g. Alloc{host="a"}.
+// Metrics without labels are identified by the name alone.
+func SeriesKey(m Metrics) string {
+
+	if len(m.Labels) == 0 {
+		return m.ID
+	}
+	return m.ID + "{" + LabelsString(m.Labels) + "}"
+}
+
+// ParseSeriesKey function splits the identity produced by SeriesKey into the name and the labels.
+// Keys that do not end with a valid label set are treated as names without labels.
+func ParseSeriesKey(key string) (string, map[string]string) {
+
+	start := strings.IndexByte(key, '{')
+	if start < 0 || !strings.HasSuffix(key, "}") {
+		return key, nil
+	}
+	labels, err := ParseLabels(key[start+1 : len(key)-1])
+	if err != nil || len(labels) == 0 {
+		return key, nil
+	}
+	return key[:start], labels
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelsString(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{
+			name: "no labels",
+			want: "",
+		},
+		{
+			name:   "sorted by name",
+			labels: map[string]string{"zone": "eu", "host": "a"},
+			want:   `host="a",zone="eu"`,
+		},
+		{
+			name:   "escaped value",
+			labels: map[string]string{"path": "C:\\tmp \"x\"\n"},
+			want:   `path="C:\\tmp \"x\"\n"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := LabelsString(tt.labels)
+			assert.Equal(t, tt.want, s)
+
+			parsed, err := ParseLabels(s)
+			require.NoError(t, err)
+			if len(tt.labels) == 0 {
+				assert.Nil(t, parsed)
+				return
+			}
+			assert.Equal(t, tt.labels, parsed)
+		})
+	}
+}
+
+func TestParseLabelsInvalid(t *testing.T) {
+
+	for _, s := range []string{`host`, `host="a`, `host="a",`, `1host="a"`, `host="a"zone="b"`, `host="a",host="b"`} {
+		_, err := ParseLabels(s)
+		assert.ErrorIs(t, err, ErrInvalidLabels, s)
+	}
+}
+
+func TestValidName(t *testing.T) {
+
+	for _, name := range []string{"Alloc", "1st.value", "<Alloc>", "http_requests:rate5m"} {
+		assert.True(t, ValidName(name), name)
+	}
+	for _, name := range []string{"", `Alloc{host="a"}`, "Alloc}", "Alloc\n"} {
+		assert.False(t, ValidName(name), name)
+	}
+}
+
+func TestSeriesKey(t *testing.T) {
+
+	value := 1.5
+	m := Metrics{ID: "Alloc", MType: Gauge, Value: &value, Labels: map[string]string{"host": "a,b}"}}
+	key := SeriesKey(m)
+	assert.Equal(t, `Alloc{host="a,b}"}`, key)
+
+	id, labels := ParseSeriesKey(key)
+	assert.Equal(t, "Alloc", id)
+	assert.Equal(t, m.Labels, labels)
+
+	id, labels = ParseSeriesKey("Alloc{broken}")
+	assert.Equal(t, "Alloc{broken}", id)
+	assert.Nil(t, labels)
+
+	assert.NotEqual(t, MetricsHash(m, "key"), MetricsHash(Metrics{ID: "Alloc", MType: Gauge, Value: &value}, "key"))
+}
@@ -8,17 +8,25 @@ import (
 	"log"
 	"math/rand"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/httpp"
 )
 
-// Container object allows collection of dynamic system metrics.
-var Container map[string]interface{}
+// Actions on the stored system metrics that are signed with ActionHash.
+const (
+	ActionDelete = "delete"
+	ActionReset  = "reset"
+)
 
 // System metrics may belong to either counter or gauge type where "counter" is always an integer and "gauge" is a float value.
+// "histogram" metrics carry the distribution of observed values over the configured buckets.
 const (
-	Counter = "counter"
-	Gauge   = "gauge"
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
 )
 
 // Metrics struct is used for storing system metrics and also for exchanging data between the data collecting agent and the server.
@@ -27,7 +35,45 @@ type Metrics struct {
 	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
 	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
 	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
-	Hash  string   `json:"hash,omitempty"`  // значение хеш-функции
+	// значение метрики в случае передачи histogram
+	Histogram *HistogramValue `json:"histogram,omitempty"`
+	// метки, различающие метрики с одним именем, например, отправленные разными агентами
+	Labels map[string]string `json:"labels,omitempty"`
+	Hash   string            `json:"hash,omitempty"` // значение хеш-функции
+	// время последнего обновления метрики на сервере, заполняется хранилищем
+	Updated *time.Time `json:"updated,omitempty"`
+	// признак метрики, которая не обновлялась дольше заданного на сервере TTL
+	Stale bool `json:"stale,omitempty"`
+}
+
+// HistogramValue struct holds the observations of a histogram metric. Bounds are the ascending upper bounds of the buckets,
+// Buckets are the non-cumulative observation counts with an extra last bucket for the values above the largest bound.
+// Received histograms are added to the stored ones, so agents report the observations made since the previous report.
+type HistogramValue struct {
+	Count   uint64    `json:"count"`
+	Sum     float64   `json:"sum"`
+	Bounds  []float64 `json:"bounds"`
+	Buckets []uint64  `json:"buckets"`
+}
+
+// ValidType function reports whether the system metric type is supported.
+func ValidType(mtype string) bool {
+
+	return mtype == Counter || mtype == Gauge || mtype == Histogram
+}
+
+// HasValue function reports whether the metric carries the value field of its type.
+func HasValue(m Metrics) bool {
+
+	switch m.MType {
+	case Counter:
+		return m.Delta != nil
+	case Gauge:
+		return m.Value != nil
+	case Histogram:
+		return m.Histogram != nil
+	}
+	return false
 }
 
 // MetricsContainer struct has all the system metrics available from the runtime.ReadMemStats and the update counter.
@@ -103,20 +149,67 @@ func MetricsUpdate(m MetricsContainer, rtm runtime.MemStats) MetricsContainer {
 }
 
 // MetricsHash function allows to hash the Metrics struct with system metrics using http.Hash algorythm.
+// The labels are hashed together with the name, metrics without labels keep the original hash.
+// Counters and gauges without the value have an empty hash.
 func MetricsHash(m Metrics, key string) string {
 
 	var strHash string
 	var err error
+	if (m.MType == Counter || m.MType == Gauge) && !HasValue(m) {
+		// there is nothing to sign, the metric is rejected by the storage
+		return ""
+	}
+	id := SeriesKey(m)
 	if m.MType == Counter {
-		strHash, err = httpp.Hash(fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta), key)
+		strHash, err = httpp.Hash(fmt.Sprintf("%s:counter:%d", id, *m.Delta), key)
+		if err != nil {
+			log.Fatalf("Error happened when hashing received value. Err: %s", err)
+		}
+	} else if m.MType == Histogram {
+		h := m.Histogram
+		if h == nil {
+			h = &HistogramValue{}
+		}
+		strHash, err = httpp.Hash(fmt.Sprintf("%s:histogram:%d:%s:%s", id, h.Count, formatFloat(h.Sum), histogramString(h)), key)
 		if err != nil {
 			log.Fatalf("Error happened when hashing received value. Err: %s", err)
 		}
 	} else {
-		strHash, err = httpp.Hash(fmt.Sprintf("%s:gauge:%f", m.ID, *m.Value), key)
+		strHash, err = httpp.Hash(fmt.Sprintf("%s:gauge:%s", id, formatFloat(*m.Value)), key)
 		if err != nil {
 			log.Fatalf("Error happened when hashing received value. Err: %s", err)
 		}
 	}
 	return strHash
 }
+
+// ActionHash function allows to hash the delete or reset request for the system metric using http.Hash algorythm.
+// The unix time the request is signed at is hashed as well, so the server can refuse the requests replayed later.
+func ActionHash(action string, m Metrics, signedAt int64, key string) string {
+
+	strHash, err := httpp.Hash(fmt.Sprintf("%s:%s:%s:%d", SeriesKey(m), m.MType, action, signedAt), key)
+	if err != nil {
+		log.Fatalf("Error happened when hashing received value. Err: %s", err)
+	}
+	return strHash
+}
+
+// histogramString function formats the histogram bounds and bucket counts for hashing.
+func histogramString(h *HistogramValue) string {
+
+	parts := make([]string, 0, len(h.Bounds)+len(h.Buckets))
+	for _, bound := range h.Bounds {
+		parts = append(parts, formatFloat(bound))
+	}
+	for _, count := range h.Buckets {
+		parts = append(parts, fmt.Sprintf("%d", count))
+	}
+	return strings.Join(parts, ",")
+}
+
+// formatFloat function returns the shortest representation of the value that parses back to it exactly,
+// so the hash covers the full precision of the gauge values and the histogram bounds and sum.
+func formatFloat(v float64) string {
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
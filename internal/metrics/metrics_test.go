@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHashMissingValue(t *testing.T) {
+
+	assert.Empty(t, MetricsHash(Metrics{ID: "x", MType: Counter}, "secret"))
+	assert.Empty(t, MetricsHash(Metrics{ID: "x", MType: Gauge}, "secret"))
+
+	delta := int64(1)
+	assert.NotEmpty(t, MetricsHash(Metrics{ID: "x", MType: Counter, Delta: &delta}, "secret"))
+}
+
+func TestMetricsHashHistogramPrecision(t *testing.T) {
+
+	histogram := func(bound, sum float64) Metrics {
+		return Metrics{ID: "latency", MType: Histogram, Histogram: &HistogramValue{Bounds: []float64{bound}, Buckets: []uint64{1, 0}, Count: 1, Sum: sum}}
+	}
+	assert.NotEqual(t, MetricsHash(histogram(1e-7, 1), "secret"), MetricsHash(histogram(2e-7, 1), "secret"))
+	assert.NotEqual(t, MetricsHash(histogram(1, 0.1234567), "secret"), MetricsHash(histogram(1, 0.1234568), "secret"))
+	assert.Equal(t, MetricsHash(histogram(1e-7, 1), "secret"), MetricsHash(histogram(1e-7, 1), "secret"))
+}
+
+func TestMetricsHashGaugePrecision(t *testing.T) {
+
+	gauge := func(value float64) Metrics {
+		return Metrics{ID: "Alloc", MType: Gauge, Value: &value}
+	}
+	assert.NotEqual(t, MetricsHash(gauge(0.1234567), "secret"), MetricsHash(gauge(0.1234568), "secret"))
+	assert.NotEqual(t, MetricsHash(gauge(1e-9), "secret"), MetricsHash(gauge(2e-9), "secret"))
+	assert.Equal(t, MetricsHash(gauge(1e-9), "secret"), MetricsHash(gauge(1e-9), "secret"))
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/auth"
+)
+
+// AuthHandler function returns a wrapper admitting only the requests with a bearer token granting the scope.
+// Requests without a known token are rejected with 401, requests with a token lacking the scope with 403.
+// The token is passed to the handler in the request context.
+func AuthHandler(a *auth.Authenticator, scope string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			t, err := a.Authorize(r.Context(), auth.BearerToken(r.Header.Get("Authorization")), scope)
+			switch {
+			case errors.Is(err, auth.ErrUnauthorized):
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			case errors.Is(err, auth.ErrForbidden):
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			case err != nil:
+				log.Printf("Error happened when checking token. Err: %s", err)
+				http.Error(w, "token check failed", http.StatusInternalServerError)
+				return
+			}
+			h.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), t)))
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/encryption"
+)
+
+// MaxEncryptedBody is the largest encrypted request body accepted by DecryptHandler.
+const MaxEncryptedBody = 32 << 20
+
+// DecryptHandler function returns a wrapper decrypting the request bodies encrypted by the agent with the server public key.
+// It has to wrap GzipHandler, since the agent compresses the body before encrypting it.
+// Requests without the encryption header are passed through unchanged.
+func DecryptHandler(key *rsa.PrivateKey) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			scheme := r.Header.Get(encryption.Header)
+			if scheme == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if scheme != encryption.Scheme {
+				http.Error(w, "unsupported encryption scheme", http.StatusBadRequest)
+				return
+			}
+
+			message, err := io.ReadAll(io.LimitReader(r.Body, MaxEncryptedBody+1))
+			r.Body.Close()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if len(message) > MaxEncryptedBody {
+				http.Error(w, "request body is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			body, err := encryption.Decrypt(key, message)
+			if err != nil {
+				log.Printf("Error happened in decrypting request body. Err: %s", err)
+				http.Error(w, "request body decryption failed", http.StatusBadRequest)
+				return
+			}
+
+			r.Header.Del(encryption.Header)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/httpp"
+)
+
+// HashHeader is the header carrying the HMAC-SHA256 of the whole request or response body.
+const HashHeader = "HashSHA256"
+
+// MaxSignedBody is the largest request body accepted by HashHandler.
+const MaxSignedBody = 32 << 20
+
+// HashHandler function returns a wrapper verifying the HashSHA256 header of the request against its body
+// and signing the response the same way. Requests with a missing or wrong hash are rejected with 400.
+// It has to be wrapped by GzipHandler and DecryptHandler, the hash covers the plain body.
+func HashHandler(key string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			body, err := io.ReadAll(io.LimitReader(r.Body, MaxSignedBody+1))
+			r.Body.Close()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if len(body) > MaxSignedBody {
+				http.Error(w, "request body is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			received := r.Header.Get(HashHeader)
+			if testHash := httpp.BodyHash(body, key); !hmac.Equal([]byte(testHash), []byte(received)) {
+				log.Printf("Hashing values do not match. Value produced: %s. Value received: %s", testHash, received)
+				http.Error(w, "request body hash does not match", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			hw := &httpp.HashWriter{ResponseWriter: w}
+			h.ServeHTTP(hw, r)
+			if hw.Status == 0 {
+				hw.Status = http.StatusOK
+			}
+			w.Header().Set(HashHeader, httpp.BodyHash(hw.Body.Bytes(), key))
+			w.WriteHeader(hw.Status)
+			w.Write(hw.Body.Bytes())
+		})
+	}
+}
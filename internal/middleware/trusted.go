@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+)
+
+// RealIPHeader is the request header carrying the address of the agent interface the request was sent from.
+const RealIPHeader = "X-Real-IP"
+
+// TrustedIP function reports whether the address received in the X-Real-IP header belongs to the trusted subnet.
+func TrustedIP(subnet *net.IPNet, realIP string) bool {
+
+	ip := net.ParseIP(realIP)
+	return ip != nil && subnet.Contains(ip)
+}
+
+// TrustedSubnetHandler function returns a wrapper rejecting with 403 the requests
+// whose X-Real-IP header is missing or does not belong to the trusted subnet.
+func TrustedSubnetHandler(subnet *net.IPNet) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			if !TrustedIP(subnet, r.Header.Get(RealIPHeader)) {
+				http.Error(w, "agent address is not trusted", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
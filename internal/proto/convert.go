@@ -0,0 +1,88 @@
+// Proto package contains the protobuf-defined gRPC service for receiving and querying system metrics.
+// The code is generated from metrics.proto with protoc v3.21.12, protoc-gen-go v1.30.0 and protoc-gen-go-grpc v1.3.0:
+//
+//	protoc --go_out=paths=source_relative:. --go-grpc_out=paths=source_relative:. metrics.proto
+//
+// Available at https://github.com/SiberianMonster/go-musthave-devops-tpl/internal/proto
+package proto
+
+import (
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// FromMetrics function converts the system metric to its protobuf representation.
+func FromMetrics(mp metrics.Metrics) *Metric {
+
+	m := &Metric{
+		Id:     mp.ID,
+		Type:   mp.MType,
+		Delta:  mp.Delta,
+		Value:  mp.Value,
+		Labels: mp.Labels,
+		Hash:   mp.Hash,
+		Stale:  mp.Stale,
+	}
+	if mp.Histogram != nil {
+		m.Histogram = &Histogram{
+			Count:   mp.Histogram.Count,
+			Sum:     mp.Histogram.Sum,
+			Bounds:  mp.Histogram.Bounds,
+			Buckets: mp.Histogram.Buckets,
+		}
+	}
+	if mp.Updated != nil {
+		m.Updated = timestamppb.New(*mp.Updated)
+	}
+	return m
+}
+
+// ToMetrics function converts the protobuf representation of the system metric back to metrics.Metrics.
+// Empty label maps are converted to nil, so the metric is hashed and stored the same way as the one received over HTTP.
+func ToMetrics(m *Metric) metrics.Metrics {
+
+	mp := metrics.Metrics{
+		ID:    m.GetId(),
+		MType: m.GetType(),
+		Delta: m.Delta,
+		Value: m.Value,
+		Hash:  m.GetHash(),
+		Stale: m.GetStale(),
+	}
+	if len(m.GetLabels()) > 0 {
+		mp.Labels = m.GetLabels()
+	}
+	if h := m.GetHistogram(); h != nil {
+		mp.Histogram = &metrics.HistogramValue{
+			Count:   h.GetCount(),
+			Sum:     h.GetSum(),
+			Bounds:  h.GetBounds(),
+			Buckets: h.GetBuckets(),
+		}
+	}
+	if m.GetUpdated() != nil {
+		updated := m.GetUpdated().AsTime()
+		mp.Updated = &updated
+	}
+	return mp
+}
+
+// FromMetricsBatch function converts a slice of system metrics to their protobuf representation.
+func FromMetricsBatch(mb []metrics.Metrics) []*Metric {
+
+	batch := make([]*Metric, 0, len(mb))
+	for _, mp := range mb {
+		batch = append(batch, FromMetrics(mp))
+	}
+	return batch
+}
+
+// ToMetricsBatch function converts a slice of protobuf system metrics to metrics.Metrics.
+func ToMetricsBatch(batch []*Metric) []metrics.Metrics {
+
+	mb := make([]metrics.Metrics, 0, len(batch))
+	for _, m := range batch {
+		mb = append(mb, ToMetrics(m))
+	}
+	return mb
+}
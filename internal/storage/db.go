@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+// upsertQuery adds counter deltas to the stored ones and replaces gauge values and the update time in a single atomic statement.
+const upsertQuery = "INSERT INTO metrics (name, type, labels, delta, value, updated_at) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (name, type, labels) DO UPDATE SET delta = metrics.delta + EXCLUDED.delta, value = EXCLUDED.value, updated_at = EXCLUDED.updated_at"
+
+// historyQuery records a timestamped sample in the history mode.
+const historyQuery = "INSERT INTO metrics_history (name, type, labels, delta, value, recorded_at) VALUES ($1, $2, $3, $4, $5, $6)"
+
+// DBStorage keeps received system metrics in a SQL database. Postgres and SQLite databases are supported.
+type DBStorage struct {
+	db      *sql.DB
+	dialect Dialect
+	history bool
+}
+
+// NewDBStorage function opens connection to the database selected by DATABASE_DSN value and applies pending schema migrations.
+// The context bounds the migrations, which may rewrite large tables, so it should not carry the short query timeout.
+func NewDBStorage(ctx context.Context, connStr string) (*DBStorage, error) {
+
+	db, d, err := openDB(connStr)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := d.Migrations()
+	if err != nil {
+		log.Printf("Error happened when loading migrations. Err: %s", err)
+		db.Close()
+		return nil, err
+	}
+	if err = Migrate(ctx, db, d, migrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DBStorage{db: db, dialect: d}, nil
+}
+
+// Update function performs the operation of inserting new system metrics to a SQL database with a query.
+func (ds *DBStorage) Update(ctx context.Context, mp metrics.Metrics) error {
+
+	if err := validate(mp); err != nil {
+		return err
+	}
+	if ds.history || mp.MType == metrics.Histogram {
+		return ds.UpdateBatch(ctx, []metrics.Metrics{mp})
+	}
+	_, err := ds.db.ExecContext(ctx, upsertQuery,
+		mp.ID,
+		mp.MType,
+		metrics.LabelsString(mp.Labels),
+		mp.Delta,
+		mp.Value,
+		ds.dialect.timeArg(time.Now()),
+	)
+	if err != nil {
+		log.Printf("Error happened when inserting a new entry into sql table. Err: %s", err)
+		return err
+	}
+	log.Printf("saved metrics data to DB")
+	return nil
+}
+
+// UpdateBatch function performs the operation of inserting a batch of system metrics to a SQL database with a transaction.
+func (ds *DBStorage) UpdateBatch(ctx context.Context, mb []metrics.Metrics) error {
+
+	for _, v := range mb {
+		if err := validate(v); err != nil {
+			return err
+		}
+	}
+
+	// шаг 1 — объявляем транзакцию
+	tx, err := ds.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("Error happened when initiating sql transaction. Err: %s", err)
+		return err
+	}
+	// шаг 1.1 — если возникает ошибка, откатываем изменения
+	defer tx.Rollback()
+
+	// шаг 2 — готовим инструкцию
+	stmt, err := tx.PrepareContext(ctx, upsertQuery)
+	if err != nil {
+		log.Printf("Error happened when preparing sql transaction context. Err: %s", err)
+		return err
+	}
+	// шаг 2.1 — не забываем закрыть инструкцию, когда она больше не нужна
+	defer stmt.Close()
+
+	var historyStmt *sql.Stmt
+	if ds.history {
+		historyStmt, err = tx.PrepareContext(ctx, historyQuery)
+		if err != nil {
+			log.Printf("Error happened when preparing sql transaction context. Err: %s", err)
+			return err
+		}
+		defer historyStmt.Close()
+	}
+
+	received := time.Now()
+	for _, v := range mb {
+		if v.MType == metrics.Histogram {
+			if err = ds.updateHistogram(ctx, tx, v, received); err != nil {
+				log.Printf("Error happened when merging histogram. Err: %s", err)
+				return err
+			}
+			continue
+		}
+		// шаг 3 — указываем, что каждое будет добавлено в транзакцию
+		labels := metrics.LabelsString(v.Labels)
+		if _, err = stmt.ExecContext(ctx, v.ID, v.MType, labels, v.Delta, v.Value, ds.dialect.timeArg(received)); err != nil {
+			log.Printf("Error happened when declaring transaction. Err: %s", err)
+			return err
+		}
+		if historyStmt == nil {
+			continue
+		}
+		if _, err = historyStmt.ExecContext(ctx, v.ID, v.MType, labels, v.Delta, v.Value, ds.dialect.timeArg(received)); err != nil {
+			log.Printf("Error happened when recording metrics history. Err: %s", err)
+			return err
+		}
+	}
+	// шаг 4 — сохраняем изменения
+
+	return tx.Commit()
+}
+
+// updateHistogram function merges the received histogram with the stored one within the transaction.
+// The row is created first, so concurrent transactions wait for the row lock instead of failing on the insert.
+func (ds *DBStorage) updateHistogram(ctx context.Context, tx *sql.Tx, mp metrics.Metrics, received time.Time) error {
+
+	labels := metrics.LabelsString(mp.Labels)
+	_, err := tx.ExecContext(ctx, "INSERT INTO metrics (name, type, labels) VALUES ($1, $2, $3) ON CONFLICT (name, type, labels) DO NOTHING;", mp.ID, mp.MType, labels)
+	if err != nil {
+		return err
+	}
+	var stored dbHistogram
+	err = tx.QueryRowContext(ctx, "SELECT histogram FROM metrics WHERE name = ($1) AND type = ($2) AND labels = ($3)"+ds.dialect.lockRow+";", mp.ID, mp.MType, labels).Scan(&stored)
+	if err != nil {
+		return err
+	}
+	merged, err := mergeHistogram(stored.HistogramValue, *mp.Histogram)
+	if err != nil {
+		return err
+	}
+	arg, err := histogramArg(&merged)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE metrics SET histogram = ($4), updated_at = ($5) WHERE name = ($1) AND type = ($2) AND labels = ($3);",
+		mp.ID, mp.MType, labels, arg, ds.dialect.timeArg(received))
+	return err
+}
+
+// Get function performs the operation of retrieving system metrics of the requested type from a SQL database with a query.
+func (ds *DBStorage) Get(ctx context.Context, mp metrics.Metrics) (metrics.Metrics, error) {
+
+	if !metrics.ValidType(mp.MType) {
+		return mp, ErrNotFound
+	}
+	var h dbHistogram
+	var updated dbTime
+	err := ds.db.QueryRowContext(ctx, "SELECT delta, value, histogram, updated_at FROM metrics WHERE name = ($1) AND type = ($2) AND labels = ($3);",
+		mp.ID, mp.MType, metrics.LabelsString(mp.Labels)).Scan(&mp.Delta, &mp.Value, &h, &updated)
+	mp.Histogram = h.HistogramValue
+	if err == sql.ErrNoRows {
+		return mp, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error happened when extracting entry from sql table. Err: %s", err)
+		return mp, err
+	}
+	mp.Updated = &updated.Time
+	log.Printf("uploaded data from DB")
+	s, err := json.Marshal(mp)
+	if err != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", err)
+		return mp, err
+	}
+	log.Print(string(s))
+	return mp, nil
+}
+
+// Delete function performs the operation of removing a system metric and its history from a SQL database with a transaction.
+func (ds *DBStorage) Delete(ctx context.Context, mp metrics.Metrics) error {
+
+	deleted, err := ds.delete(ctx, []metrics.Metrics{mp})
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteBatch function performs the operation of removing a batch of system metrics from a SQL database with a transaction.
+func (ds *DBStorage) DeleteBatch(ctx context.Context, mb []metrics.Metrics) error {
+
+	_, err := ds.delete(ctx, mb)
+	return err
+}
+
+// Reset function performs the operation of setting a stored counter to zero with a query.
+func (ds *DBStorage) Reset(ctx context.Context, mp metrics.Metrics) error {
+
+	if mp.MType != metrics.Counter {
+		return ErrWrongType
+	}
+	res, err := ds.db.ExecContext(ctx, "UPDATE metrics SET delta = 0, updated_at = ($4) WHERE name = ($1) AND type = ($2) AND labels = ($3);",
+		mp.ID, mp.MType, metrics.LabelsString(mp.Labels), ds.dialect.timeArg(time.Now()))
+	if err != nil {
+		log.Printf("Error happened when resetting entry in sql table. Err: %s", err)
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// delete function removes the system metrics and their history in a single transaction and returns the number of removed metrics.
+func (ds *DBStorage) delete(ctx context.Context, mb []metrics.Metrics) (int64, error) {
+
+	tx, err := ds.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("Error happened when initiating sql transaction. Err: %s", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "DELETE FROM metrics WHERE name = ($1) AND type = ($2) AND labels = ($3);")
+	if err != nil {
+		log.Printf("Error happened when preparing sql transaction context. Err: %s", err)
+		return 0, err
+	}
+	defer stmt.Close()
+
+	// the history table exists regardless of the history mode, stale samples are removed as well
+	historyStmt, err := tx.PrepareContext(ctx, "DELETE FROM metrics_history WHERE name = ($1) AND type = ($2) AND labels = ($3);")
+	if err != nil {
+		log.Printf("Error happened when preparing sql transaction context. Err: %s", err)
+		return 0, err
+	}
+	defer historyStmt.Close()
+
+	var deleted int64
+	for _, v := range mb {
+		labels := metrics.LabelsString(v.Labels)
+		res, err := stmt.ExecContext(ctx, v.ID, v.MType, labels)
+		if err != nil {
+			log.Printf("Error happened when deleting entry from sql table. Err: %s", err)
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		deleted += n
+		if _, err = historyStmt.ExecContext(ctx, v.ID, v.MType, labels); err != nil {
+			log.Printf("Error happened when deleting history from sql table. Err: %s", err)
+			return 0, err
+		}
+	}
+	return deleted, tx.Commit()
+}
+
+// Expire function performs the operation of removing the stale gauges and their history from a SQL database with a transaction.
+func (ds *DBStorage) Expire(ctx context.Context, before time.Time) (int, error) {
+
+	tx, err := ds.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("Error happened when initiating sql transaction. Err: %s", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	beforeArg := ds.dialect.timeArg(before)
+	_, err = tx.ExecContext(ctx, "DELETE FROM metrics_history WHERE (name, type, labels) IN (SELECT name, type, labels FROM metrics WHERE type = ($1) AND updated_at < ($2));",
+		metrics.Gauge, beforeArg)
+	if err != nil {
+		log.Printf("Error happened when deleting history from sql table. Err: %s", err)
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM metrics WHERE type = ($1) AND updated_at < ($2);", metrics.Gauge, beforeArg)
+	if err != nil {
+		log.Printf("Error happened when deleting entries from sql table. Err: %s", err)
+		return 0, err
+	}
+	expired, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(expired), tx.Commit()
+}
+
+// List function performs the operation of retrieving all system metrics from a SQL database with a query.
+func (ds *DBStorage) List(ctx context.Context) ([]metrics.Metrics, error) {
+
+	rows, err := ds.db.QueryContext(ctx, "SELECT name, type, labels, delta, value, histogram, updated_at FROM metrics;")
+	if err != nil {
+		log.Printf("Error happened when extracting entries from sql table. Err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	mb := []metrics.Metrics{}
+	for rows.Next() {
+		var mp metrics.Metrics
+		var h dbHistogram
+		var updated dbTime
+		var labels string
+		if err = rows.Scan(&mp.ID, &mp.MType, &labels, &mp.Delta, &mp.Value, &h, &updated); err != nil {
+			log.Printf("Error happened when scanning entries from sql table. Err: %s", err)
+			return nil, err
+		}
+		mp.Histogram = h.HistogramValue
+		mp.Updated = &updated.Time
+		if mp.Labels, err = metrics.ParseLabels(labels); err != nil {
+			log.Printf("Error happened when parsing labels from sql table. Err: %s", err)
+			return nil, err
+		}
+		mb = append(mb, mp)
+	}
+	return mb, rows.Err()
+}
+
+// EnableHistory function switches on recording of every received sample to the metrics_history table.
+func (ds *DBStorage) EnableHistory() {
+
+	ds.history = true
+}
+
+// History function performs the operation of retrieving the samples received within the [from, to] interval with a query.
+func (ds *DBStorage) History(ctx context.Context, mp metrics.Metrics, from, to time.Time) ([]Sample, error) {
+
+	if !ds.history {
+		return nil, ErrHistoryDisabled
+	}
+	rows, err := ds.db.QueryContext(ctx, "SELECT recorded_at, delta, value FROM metrics_history WHERE name = ($1) AND type = ($2) AND labels = ($3) AND recorded_at >= ($4) AND recorded_at <= ($5) ORDER BY recorded_at;",
+		mp.ID, mp.MType, metrics.LabelsString(mp.Labels), ds.dialect.timeArg(from), ds.dialect.timeArg(to))
+	if err != nil {
+		log.Printf("Error happened when extracting history from sql table. Err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := []Sample{}
+	for rows.Next() {
+		var sample Sample
+		var recorded dbTime
+		if err = rows.Scan(&recorded, &sample.Delta, &sample.Value); err != nil {
+			log.Printf("Error happened when scanning history from sql table. Err: %s", err)
+			return nil, err
+		}
+		sample.Time = recorded.Time
+		samples = append(samples, sample)
+	}
+	return samples, rows.Err()
+}
+
+// Ping function sends ping requests to the database to check existing connection.
+func (ds *DBStorage) Ping(ctx context.Context) error {
+
+	return ds.db.PingContext(ctx)
+}
+
+// Close function closes connection to the database.
+func (ds *DBStorage) Close() error {
+
+	return ds.db.Close()
+}
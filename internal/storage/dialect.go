@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// SQLitePrefix marks DATABASE_DSN values that select the embedded SQLite storage, e.g. sqlite:///var/lib/metrics.db.
+const SQLitePrefix = "sqlite://"
+
+// Dialect struct describes the differences between the supported SQL databases.
+type Dialect struct {
+	// Driver is the database/sql driver name.
+	Driver string
+	// migrationsDir is the directory of the embedded schema migrations.
+	migrationsDir string
+	// versionTableQuery checks that the schema_version table exists.
+	versionTableQuery string
+	// createVersionTable creates the schema_version table.
+	createVersionTable string
+	// timeArg converts time values to the query arguments of the update and history timestamps.
+	timeArg func(t time.Time) interface{}
+	// lockRow is appended to the queries reading a row that is updated in the same transaction.
+	lockRow string
+	// lockMigrations and unlockMigrations take and release the lock serializing the migration runs of the servers
+	// sharing the database, both are executed with the migrationLockID argument.
+	lockMigrations   string
+	unlockMigrations string
+}
+
+// Postgres dialect stores timestamps as timestamptz values.
+var Postgres = Dialect{
+	Driver:             "postgres",
+	migrationsDir:      "migrations/postgres",
+	versionTableQuery:  "SELECT to_regclass('schema_version') IS NOT NULL;",
+	createVersionTable: "CREATE TABLE IF NOT EXISTS schema_version (version int PRIMARY KEY, name text NOT NULL, applied_at timestamptz NOT NULL DEFAULT now());",
+	timeArg:            func(t time.Time) interface{} { return t },
+	lockRow:            " FOR UPDATE",
+	lockMigrations:     "SELECT pg_advisory_lock($1);",
+	unlockMigrations:   "SELECT pg_advisory_unlock($1);",
+}
+
+// SQLite dialect stores timestamps as unix nanoseconds.
+var SQLite = Dialect{
+	Driver:             "sqlite",
+	migrationsDir:      "migrations/sqlite",
+	versionTableQuery:  "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema_version');",
+	createVersionTable: "CREATE TABLE IF NOT EXISTS schema_version (version integer PRIMARY KEY, name text NOT NULL, applied_at text NOT NULL DEFAULT CURRENT_TIMESTAMP);",
+	timeArg:            func(t time.Time) interface{} { return t.UnixNano() },
+	// SQLite has no row locks, transactions are serialized on a single connection
+	lockRow: "",
+	// SQLite database files are not shared between servers, the migration runs are not locked
+	lockMigrations:   "",
+	unlockMigrations: "",
+}
+
+// Migrations function returns the embedded schema migrations of the dialect.
+func (d Dialect) Migrations() ([]Migration, error) {
+
+	return LoadMigrations(migrationsFS, d.migrationsDir)
+}
+
+// ParseDSN function selects the SQL dialect by DATABASE_DSN value and returns the data source name for its driver.
+// Values starting with sqlite:// are treated as SQLite database paths, all the others are passed to Postgres.
+func ParseDSN(connStr string) (Dialect, string) {
+
+	if !strings.HasPrefix(connStr, SQLitePrefix) {
+		return Postgres, connStr
+	}
+	path := strings.TrimPrefix(connStr, SQLitePrefix)
+	if path == ":memory:" {
+		return SQLite, path
+	}
+	return SQLite, "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+}
+
+// openDB function opens the database selected by DATABASE_DSN value.
+func openDB(connStr string) (*sql.DB, Dialect, error) {
+
+	d, dsn := ParseDSN(connStr)
+	db, err := sql.Open(d.Driver, dsn)
+	if err != nil {
+		log.Printf("Error happened when initiating connection to the db. Err: %s", err)
+		return nil, d, err
+	}
+	if d.Driver == SQLite.Driver {
+		// SQLite allows a single writer, queries are serialized on one connection to avoid busy errors
+		db.SetMaxOpenConns(1)
+	}
+	return db, d, nil
+}
+
+// DBPendingMigrations function returns the migrations that would be applied to the database on startup.
+func DBPendingMigrations(ctx context.Context, connStr string) ([]Migration, error) {
+
+	db, d, err := openDB(connStr)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	migrations, err := d.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	return PendingMigrations(ctx, db, d, migrations)
+}
+
+// dbTime type scans timestamps stored either as time values or as unix nanoseconds.
+type dbTime struct {
+	time.Time
+}
+
+// Scan function implements sql.Scanner interface for the dbTime type.
+func (t *dbTime) Scan(src interface{}) error {
+
+	switch value := src.(type) {
+	case time.Time:
+		t.Time = value
+	case int64:
+		t.Time = time.Unix(0, value)
+	default:
+		return fmt.Errorf("unsupported time value %T", src)
+	}
+	return nil
+}
+
+// dbHistogram type scans json-encoded histogram values.
+type dbHistogram struct {
+	*metrics.HistogramValue
+}
+
+// Scan function implements sql.Scanner interface for the dbHistogram type.
+func (h *dbHistogram) Scan(src interface{}) error {
+
+	var data []byte
+	switch value := src.(type) {
+	case nil:
+		h.HistogramValue = nil
+		return nil
+	case string:
+		data = []byte(value)
+	case []byte:
+		data = value
+	default:
+		return fmt.Errorf("unsupported histogram value %T", src)
+	}
+	h.HistogramValue = &metrics.HistogramValue{}
+	return json.Unmarshal(data, h.HistogramValue)
+}
+
+// histogramArg function converts the histogram value to the query argument.
+func histogramArg(h *metrics.HistogramValue) (interface{}, error) {
+
+	if h == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
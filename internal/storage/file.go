@@ -0,0 +1,415 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+// SnapshotVersion is the current version of the json-file format.
+// Version 1 files consist of a single JSON line without a header.
+const SnapshotVersion = 2
+
+// ErrCorruptedSnapshot is returned when the json-file contents do not match the checksum in its header.
+var ErrCorruptedSnapshot = errors.New("corrupted metrics snapshot")
+
+// snapshotHeader struct is written as the first line of the json-file and describes the data line that follows.
+type snapshotHeader struct {
+	Version  int    `json:"version"`
+	Checksum string `json:"checksum"`
+	// WALSeq is the sequence number of the last write-ahead log record covered by the snapshot.
+	WALSeq uint64 `json:"wal_seq,omitempty"`
+}
+
+// FileStorage keeps received system metrics in memory and exports them to a json-file.
+// Every accepted update is appended to the write-ahead log before it is applied,
+// the log is compacted into the json-file snapshot at regular intervals.
+// In the synchronous mode the snapshot is saved on every update instead.
+type FileStorage struct {
+	*MemStorage
+	storeFile string
+	// mu serializes write-ahead log appends with the compaction.
+	mu  sync.Mutex
+	wal *os.File
+	// seq is the sequence number of the last operation appended to the write-ahead log.
+	seq      uint64
+	syncSave bool
+}
+
+// NewFileStorage function returns FileStorage object bound to the json-file.
+func NewFileStorage(storeFile string) *FileStorage {
+
+	return &FileStorage{MemStorage: NewMemStorage(), storeFile: storeFile}
+}
+
+// Update function records a received system metric to the write-ahead log and updates the metrics container.
+func (fs *FileStorage) Update(ctx context.Context, mp metrics.Metrics) error {
+
+	return fs.UpdateBatch(ctx, []metrics.Metrics{mp})
+}
+
+// UpdateBatch function records a slice of received system metrics to the write-ahead log and updates the metrics container.
+func (fs *FileStorage) UpdateBatch(ctx context.Context, mb []metrics.Metrics) error {
+
+	for _, mp := range mb {
+		if err := validate(mp); err != nil {
+			return err
+		}
+	}
+	check := func() error {
+		fs.MemStorage.mu.RLock()
+		defer fs.MemStorage.mu.RUnlock()
+		return fs.MemStorage.checkBounds(mb)
+	}
+	return fs.apply(walUpdate, mb, check, func(received time.Time) error { return fs.MemStorage.updateBatch(mb, received) })
+}
+
+// Delete function records the removal of a system metric to the write-ahead log and removes it from the metrics container.
+func (fs *FileStorage) Delete(ctx context.Context, mp metrics.Metrics) error {
+
+	check := func() error {
+		_, err := fs.MemStorage.Get(ctx, mp)
+		return err
+	}
+	return fs.apply(walDelete, []metrics.Metrics{mp}, check, func(time.Time) error { return fs.MemStorage.Delete(ctx, mp) })
+}
+
+// DeleteBatch function records the removal of a slice of system metrics to the write-ahead log and removes them from the metrics container.
+func (fs *FileStorage) DeleteBatch(ctx context.Context, mb []metrics.Metrics) error {
+
+	return fs.apply(walDelete, mb, nil, func(time.Time) error { return fs.MemStorage.DeleteBatch(ctx, mb) })
+}
+
+// Reset function records the counter reset to the write-ahead log and sets the stored counter to zero.
+func (fs *FileStorage) Reset(ctx context.Context, mp metrics.Metrics) error {
+
+	if mp.MType != metrics.Counter {
+		return ErrWrongType
+	}
+	check := func() error {
+		_, err := fs.MemStorage.Get(ctx, mp)
+		return err
+	}
+	return fs.apply(walReset, []metrics.Metrics{mp}, check, func(time.Time) error { return fs.MemStorage.Reset(ctx, mp) })
+}
+
+// Expire function records the removal of the stale gauges to the write-ahead log and removes them from the metrics container.
+func (fs *FileStorage) Expire(ctx context.Context, before time.Time) (int, error) {
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// updates are applied under fs.mu as well, so the gauges cannot be refreshed before they are removed
+	fs.MemStorage.mu.RLock()
+	expired := fs.MemStorage.expired(before)
+	fs.MemStorage.mu.RUnlock()
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	err := fs.applyLocked(walDelete, expired, nil, func(time.Time) error { return fs.MemStorage.DeleteBatch(ctx, expired) })
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// apply function makes the operation durable and then applies it to the metrics container.
+// The operation is appended to the write-ahead log, in the synchronous mode the json-file is saved after applying it instead
+// and the operation is rolled back when saving fails.
+// The optional check rejects the operation before it is logged, so the log only holds operations that can be replayed.
+// The change receives the time recorded to the log, so the replayed updates keep their update times.
+func (fs *FileStorage) apply(op string, mb []metrics.Metrics, check func() error, change func(time.Time) error) error {
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.applyLocked(op, mb, check, change)
+}
+
+// applyLocked function is apply for the callers already holding fs.mu.
+func (fs *FileStorage) applyLocked(op string, mb []metrics.Metrics, check func() error, change func(time.Time) error) error {
+
+	var err error
+	now := time.Now()
+	if check != nil {
+		if err = check(); err != nil {
+			return err
+		}
+	}
+	if fs.syncSave {
+		// the client retries the rejected update, so it must not be left applied
+		previous := fs.MemStorage.state()
+		if err = change(now); err != nil {
+			return err
+		}
+		if err = StaticFileSave(fs.storeFile, fs.MemStorage, fs.seq); err != nil {
+			fs.MemStorage.rollback(previous)
+			return err
+		}
+		return nil
+	}
+	if fs.wal == nil {
+		if fs.wal, err = openWAL(fs.storeFile); err != nil {
+			log.Printf("Error happened in write-ahead log opening. Err: %s", err)
+			return err
+		}
+		// without the restore the numbering continues after the snapshot left on disk,
+		// so the new records are not mistaken for the ones it covers
+		if stored := snapshotSeq(fs.storeFile); stored > fs.seq {
+			fs.seq = stored
+		}
+	}
+	fs.seq++
+	if err = appendWAL(fs.wal, walRecord{Seq: fs.seq, Time: now, Op: op, Metrics: mb}); err != nil {
+		log.Printf("Error happened when writing to write-ahead log. Err: %s", err)
+		return err
+	}
+	return change(now)
+}
+
+// EnableSyncSave function switches on the synchronous mode where the json-file is saved before every update is acknowledged.
+func (fs *FileStorage) EnableSyncSave() {
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.syncSave = true
+}
+
+// Restore function uploads previously saved system metrics from the json-file and the write-ahead log
+// and compacts them into a new snapshot.
+func (fs *FileStorage) Restore() error {
+
+	seq, err := upload(fs.storeFile, fs.MemStorage)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	fs.seq = seq
+	fs.mu.Unlock()
+	return fs.Compact()
+}
+
+// Compact function saves the system metrics to the json-file and empties the write-ahead log.
+// The snapshot records the last log record it covers, so a crash before the log is emptied
+// does not apply the covered records a second time on the next restore.
+func (fs *FileStorage) Compact() error {
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := StaticFileSave(fs.storeFile, fs.MemStorage, fs.seq); err != nil {
+		return err
+	}
+	if fs.wal != nil {
+		return fs.wal.Truncate(0)
+	}
+	if err := os.Truncate(walPath(fs.storeFile), 0); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Close function saves the collected system metrics to the json-file.
+func (fs *FileStorage) Close() error {
+
+	err := fs.Compact()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.wal != nil {
+		fs.wal.Close()
+		fs.wal = nil
+	}
+	return err
+}
+
+// StaticFileSave function saves received system metrics to json-file.
+// The data is written to a temporary file in the same directory, synced to disk and renamed over the json-file,
+// so a crash in the middle of saving leaves the previous snapshot intact.
+// The walSeq is the sequence number of the last write-ahead log record applied to the metrics.
+func StaticFileSave(storeFile string, ms *MemStorage, walSeq uint64) error {
+
+	snap := ms.snapshot()
+	data, err := json.Marshal(&snap)
+	if err != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", err)
+		return err
+	}
+	checksum := sha256.Sum256(data)
+	header, err := json.Marshal(snapshotHeader{Version: SnapshotVersion, Checksum: hex.EncodeToString(checksum[:]), WALSeq: walSeq})
+	if err != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", err)
+		return err
+	}
+
+	dir := filepath.Dir(storeFile)
+	file, err := os.CreateTemp(dir, filepath.Base(storeFile)+".tmp-*")
+	if err != nil {
+		log.Printf("Error happened in JSON file opening. Err: %s", err)
+		return err
+	}
+	// the temporary file is left only if saving fails
+	defer os.Remove(file.Name())
+
+	writer := bufio.NewWriter(file)
+	for _, line := range [][]byte{header, data} {
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+	if err = writer.Flush(); err == nil {
+		err = file.Chmod(0644)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Error happened when writing data to storage file. Err: %s", err)
+		return err
+	}
+
+	if err = os.Rename(file.Name(), storeFile); err != nil {
+		log.Printf("Error happened when replacing storage file. Err: %s", err)
+		return err
+	}
+	if err = syncDir(dir); err != nil {
+		log.Printf("Error happened when syncing storage directory. Err: %s", err)
+		return err
+	}
+	log.Printf("saved JSON to file")
+	return nil
+
+}
+
+// StaticFileUpload function uploads stored system metrics from the json-file and replays the write-ahead log over them.
+// A missing or empty file is not an error, a snapshot that fails the checksum verification returns ErrCorruptedSnapshot.
+func StaticFileUpload(storeFile string, ms *MemStorage) error {
+
+	_, err := upload(storeFile, ms)
+	return err
+}
+
+// upload function is StaticFileUpload returning the sequence number of the last write-ahead log record applied to the metrics.
+func upload(storeFile string, ms *MemStorage) (uint64, error) {
+
+	file, err := os.Open(storeFile)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No JSON file to upload")
+		return replay(storeFile, ms, 0)
+	}
+	if err != nil {
+		log.Printf("Error happened in JSON file opening. Err: %s", err)
+		return 0, err
+	}
+	defer file.Close()
+
+	log.Printf("Uploading data from JSON")
+	content, err := io.ReadAll(file)
+	if err != nil {
+		log.Printf("Error happened in reading JSON file bytes. Err: %s", err)
+		return 0, err
+	}
+	if len(bytes.TrimSpace(content)) == 0 {
+		log.Printf("No JSON data to decode")
+		return replay(storeFile, ms, 0)
+	}
+
+	snap, header, err := decodeSnapshot(content)
+	if err != nil {
+		log.Printf("Error happened in decoding JSON file %s. Err: %s", storeFile, err)
+		return 0, err
+	}
+	ms.restore(snap)
+	return replay(storeFile, ms, header.WALSeq)
+
+}
+
+// decodeSnapshot function verifies the json-file header and decodes the stored system metrics.
+func decodeSnapshot(content []byte) (memSnapshot, snapshotHeader, error) {
+
+	var snap memSnapshot
+	first, rest, _ := bytes.Cut(content, []byte{'\n'})
+
+	var header snapshotHeader
+	if err := json.Unmarshal(first, &header); err != nil {
+		return snap, header, fmt.Errorf("%w: %s", ErrCorruptedSnapshot, err)
+	}
+
+	data := first
+	switch header.Version {
+	case 0:
+		// version 1 files have no header, the first line is the data itself
+	case SnapshotVersion:
+		data, _, _ = bytes.Cut(rest, []byte{'\n'})
+		checksum := sha256.Sum256(data)
+		if hex.EncodeToString(checksum[:]) != header.Checksum {
+			return snap, header, fmt.Errorf("%w: checksum mismatch", ErrCorruptedSnapshot)
+		}
+	default:
+		return snap, header, fmt.Errorf("%w: unsupported version %d", ErrCorruptedSnapshot, header.Version)
+	}
+
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return snap, header, fmt.Errorf("%w: %s", ErrCorruptedSnapshot, err)
+	}
+	return snap, header, nil
+}
+
+// snapshotSeq function returns the sequence number of the last write-ahead log record covered by the json-file snapshot.
+// Zero is returned for a missing or unreadable file.
+func snapshotSeq(storeFile string) uint64 {
+
+	file, err := os.Open(storeFile)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	first, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return 0
+	}
+	var header snapshotHeader
+	if err = json.Unmarshal(first, &header); err != nil {
+		return 0
+	}
+	return header.WALSeq
+}
+
+// replay function applies the write-ahead log records made after the json-file snapshot
+// and returns the sequence number of the last applied record.
+func replay(storeFile string, ms *MemStorage, after uint64) (uint64, error) {
+
+	replayed, last, err := replayWAL(storeFile, ms, after)
+	if err != nil {
+		log.Printf("Error happened in replaying write-ahead log. Err: %s", err)
+		return last, err
+	}
+	log.Printf("Replayed %d write-ahead log records", replayed)
+	return last, nil
+}
+
+// syncDir function flushes the directory entry of the renamed json-file to disk.
+func syncDir(dir string) error {
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticFileRoundTrip(t *testing.T) {
+
+	storeFile := filepath.Join(t.TempDir(), "devops-metrics-db.json")
+	ctx := context.Background()
+	delta := int64(42)
+	value := 42.0
+
+	fs := NewFileStorage(storeFile)
+	require.NoError(t, fs.Update(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Delta: &delta}))
+	require.NoError(t, fs.Update(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge, Value: &value}))
+	require.NoError(t, fs.Close())
+
+	restored := NewFileStorage(storeFile)
+	require.NoError(t, restored.Restore())
+
+	mp, err := restored.Get(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	require.NoError(t, err)
+	assert.Equal(t, delta, *mp.Delta)
+
+	mp, err = restored.Get(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge})
+	require.NoError(t, err)
+	assert.Equal(t, value, *mp.Value)
+
+	// an increment after the restore must keep the counter integer
+	require.NoError(t, restored.Update(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Delta: &delta}))
+	mp, err = restored.Get(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	require.NoError(t, err)
+	assert.Equal(t, 2*delta, *mp.Delta)
+}
+
+func TestStaticFileSaveShrinks(t *testing.T) {
+
+	storeFile := filepath.Join(t.TempDir(), "devops-metrics-db.json")
+	ctx := context.Background()
+	value := 1.0
+
+	fs := NewFileStorage(storeFile)
+	for _, name := range []string{"Alloc", "BuckHashSys", "Frees", "GCSys"} {
+		require.NoError(t, fs.Update(ctx, metrics.Metrics{ID: name, MType: metrics.Gauge, Value: &value}))
+	}
+	require.NoError(t, fs.Close())
+
+	// a smaller snapshot must fully replace the previous one
+	small := NewFileStorage(storeFile)
+	require.NoError(t, small.Update(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge, Value: &value}))
+	require.NoError(t, small.Close())
+
+	restored := NewFileStorage(storeFile)
+	require.NoError(t, restored.Restore())
+	mb, err := restored.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, mb, 1)
+
+	leftovers, err := filepath.Glob(storeFile + ".tmp-*")
+	require.NoError(t, err)
+	assert.Empty(t, leftovers, "temporary files must not be left behind")
+}
+
+func TestStaticFileUploadCorrupted(t *testing.T) {
+
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		wantErr error
+	}{
+		{
+			name:    "missing file",
+			wantErr: nil,
+		},
+		{
+			name:    "legacy snapshot without header",
+			content: `{"gauges":{"Alloc":1.5},"counters":{"PollCount":3}}` + "\n",
+			wantErr: nil,
+		},
+		{
+			name:    "checksum mismatch",
+			content: `{"version":2,"checksum":"00"}` + "\n" + `{"gauges":{"Alloc":1.5},"counters":{}}` + "\n",
+			wantErr: ErrCorruptedSnapshot,
+		},
+		{
+			name:    "unsupported version",
+			content: `{"version":99,"checksum":"00"}` + "\n",
+			wantErr: ErrCorruptedSnapshot,
+		},
+		{
+			name:    "truncated data",
+			content: `{"gauges":{"Alloc":1.`,
+			wantErr: ErrCorruptedSnapshot,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storeFile := filepath.Join(dir, tt.name+".json")
+			if i > 0 {
+				require.NoError(t, os.WriteFile(storeFile, []byte(tt.content), 0644))
+			}
+			err := StaticFileUpload(storeFile, NewMemStorage())
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestWriteAheadLogReplay(t *testing.T) {
+
+	storeFile := filepath.Join(t.TempDir(), "devops-metrics-db.json")
+	ctx := context.Background()
+	delta := int64(5)
+	value := 3.5
+
+	fs := NewFileStorage(storeFile)
+	require.NoError(t, fs.Restore())
+	require.NoError(t, fs.Update(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Delta: &delta}))
+	require.NoError(t, fs.Compact())
+	require.NoError(t, fs.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "PollCount", MType: metrics.Counter, Delta: &delta},
+		{ID: "Alloc", MType: metrics.Gauge, Value: &value},
+	}))
+
+	// simulate a crash: the storage is not closed and the last record is torn
+	wal, err := os.OpenFile(storeFile+WALSuffix, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = wal.WriteString(`{"time":"2023-01-01T00:00:00Z","metrics":[{"id":"PollCount","type":"coun`)
+	require.NoError(t, err)
+	require.NoError(t, wal.Close())
+
+	restored := NewFileStorage(storeFile)
+	require.NoError(t, restored.Restore())
+
+	mp, err := restored.Get(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	require.NoError(t, err)
+	assert.Equal(t, 2*delta, *mp.Delta)
+
+	mp, err = restored.Get(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge})
+	require.NoError(t, err)
+	assert.Equal(t, value, *mp.Value)
+
+	// the restore compacts the log into the snapshot
+	info, err := os.Stat(storeFile + WALSuffix)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+}
+
+func TestCompactCrashBeforeTruncate(t *testing.T) {
+
+	storeFile := filepath.Join(t.TempDir(), "devops-metrics-db.json")
+	ctx := context.Background()
+	delta := int64(5)
+	bounds := []float64{1}
+	histogram := metrics.Metrics{ID: "latency", MType: metrics.Histogram, Histogram: &metrics.HistogramValue{Bounds: bounds, Buckets: []uint64{1, 0}, Count: 1, Sum: 0.5}}
+
+	fs := NewFileStorage(storeFile)
+	require.NoError(t, fs.Restore())
+	require.NoError(t, fs.Update(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Delta: &delta}))
+	require.NoError(t, fs.Update(ctx, histogram))
+
+	// simulate a crash inside Compact: the snapshot is saved, the write-ahead log is not emptied
+	fs.mu.Lock()
+	require.NoError(t, StaticFileSave(storeFile, fs.MemStorage, fs.seq))
+	fs.mu.Unlock()
+
+	restored := NewFileStorage(storeFile)
+	require.NoError(t, restored.Restore())
+	mp, err := restored.Get(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	require.NoError(t, err)
+	assert.Equal(t, delta, *mp.Delta)
+	mp, err = restored.Get(ctx, metrics.Metrics{ID: "latency", MType: metrics.Histogram})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), mp.Histogram.Count)
+
+	// the records made after the restore are still replayed after the next crash
+	require.NoError(t, restored.Update(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Delta: &delta}))
+	again := NewMemStorage()
+	require.NoError(t, StaticFileUpload(storeFile, again))
+	mp, err = again.Get(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	require.NoError(t, err)
+	assert.Equal(t, 2*delta, *mp.Delta)
+	require.NoError(t, restored.Close())
+	require.NoError(t, fs.Close())
+}
+
+func TestWriteAheadLogWithoutRestore(t *testing.T) {
+
+	storeFile := filepath.Join(t.TempDir(), "devops-metrics-db.json")
+	ctx := context.Background()
+	delta := int64(5)
+
+	fs := NewFileStorage(storeFile)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, fs.Update(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Delta: &delta}))
+	}
+	require.NoError(t, fs.Close())
+
+	// the storage started without the restore numbers its records after the snapshot left on disk
+	fresh := NewFileStorage(storeFile)
+	require.NoError(t, fresh.Update(ctx, metrics.Metrics{ID: "Sys", MType: metrics.Counter, Delta: &delta}))
+
+	restored := NewMemStorage()
+	require.NoError(t, StaticFileUpload(storeFile, restored))
+	mp, err := restored.Get(ctx, metrics.Metrics{ID: "Sys", MType: metrics.Counter})
+	require.NoError(t, err)
+	assert.Equal(t, delta, *mp.Delta)
+	require.NoError(t, fresh.Close())
+}
+
+func TestSyncSave(t *testing.T) {
+
+	storeFile := filepath.Join(t.TempDir(), "devops-metrics-db.json")
+	ctx := context.Background()
+	delta := int64(7)
+
+	fs := NewFileStorage(storeFile)
+	fs.EnableSyncSave()
+	require.NoError(t, fs.Update(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Delta: &delta}))
+
+	// the snapshot is readable without closing the storage and no write-ahead log is kept
+	restored := NewMemStorage()
+	require.NoError(t, StaticFileUpload(storeFile, restored))
+	mp, err := restored.Get(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	require.NoError(t, err)
+	assert.Equal(t, delta, *mp.Delta)
+
+	_, err = os.Stat(walPath(storeFile))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestSyncSaveFailure(t *testing.T) {
+
+	storeFile := filepath.Join(t.TempDir(), "devops-metrics-db.json")
+	ctx := context.Background()
+	delta := int64(7)
+	counter := metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Delta: &delta}
+
+	fs := NewFileStorage(storeFile)
+	fs.EnableHistory()
+	fs.EnableSyncSave()
+	require.NoError(t, fs.Update(ctx, counter))
+
+	// the snapshot cannot replace a directory, so saving fails and the update is rolled back
+	require.NoError(t, os.Remove(storeFile))
+	require.NoError(t, os.Mkdir(storeFile, 0755))
+	assert.Error(t, fs.Update(ctx, counter))
+	mp, err := fs.Get(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	require.NoError(t, err)
+	assert.Equal(t, delta, *mp.Delta)
+	samples, err := fs.History(ctx, counter, time.Now().Add(-time.Minute), time.Now())
+	require.NoError(t, err)
+	assert.Len(t, samples, 1)
+
+	// the retried update is applied once
+	require.NoError(t, os.Remove(storeFile))
+	require.NoError(t, fs.Update(ctx, counter))
+	mp, err = fs.Get(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	require.NoError(t, err)
+	assert.Equal(t, 2*delta, *mp.Delta)
+}
+
+func TestFileStorageDeleteReset(t *testing.T) {
+
+	storeFile := filepath.Join(t.TempDir(), "devops-metrics-db.json")
+	ctx := context.Background()
+
+	fs := NewFileStorage(storeFile)
+	testDeleteReset(t, fs)
+
+	// the operations are replayed from the write-ahead log without compaction
+	restored := NewMemStorage()
+	require.NoError(t, StaticFileUpload(storeFile, restored))
+	mb, err := restored.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, mb, 1)
+	assert.Equal(t, int64(0), *mb[0].Delta)
+	require.NoError(t, fs.Close())
+}
+
+func TestFileStorageHistogram(t *testing.T) {
+
+	storeFile := filepath.Join(t.TempDir(), "devops-metrics-db.json")
+	ctx := context.Background()
+
+	fs := NewFileStorage(storeFile)
+	testHistogram(t, fs)
+
+	// rejected updates are not logged, so the replay reaches the records made after them
+	delta := int64(1)
+	require.NoError(t, fs.Update(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Delta: &delta}))
+	restored := NewMemStorage()
+	require.NoError(t, StaticFileUpload(storeFile, restored))
+	_, err := restored.Get(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	require.NoError(t, err)
+
+	require.NoError(t, fs.Close())
+	restored = NewMemStorage()
+	require.NoError(t, StaticFileUpload(storeFile, restored))
+	mp, err := restored.Get(ctx, metrics.Metrics{ID: "Latency", MType: metrics.Histogram})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), mp.Histogram.Count)
+}
+
+func TestFileStorageLabels(t *testing.T) {
+
+	storeFile := filepath.Join(t.TempDir(), "devops-metrics-db.json")
+	fs := NewFileStorage(storeFile)
+	testLabels(t, fs)
+	require.NoError(t, fs.Close())
+
+	restored := NewFileStorage(storeFile)
+	require.NoError(t, restored.Restore())
+	mp, err := restored.Get(context.Background(), metrics.Metrics{ID: "Alloc", MType: metrics.Gauge,
+		Labels: map[string]string{"host": "b", "zone": "eu"}})
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, *mp.Value)
+}
+
+func TestFileStorageExpire(t *testing.T) {
+
+	storeFile := filepath.Join(t.TempDir(), "devops-metrics-db.json")
+	ctx := context.Background()
+	fs := NewFileStorage(storeFile)
+	require.NoError(t, fs.Restore())
+	testExpire(t, fs)
+	counter, err := fs.Get(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	require.NoError(t, err)
+
+	// the storage is not closed, the removal and the update times are replayed from the write-ahead log
+	restored := NewFileStorage(storeFile)
+	require.NoError(t, restored.Restore())
+	_, err = restored.Get(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge})
+	assert.ErrorIs(t, err, ErrNotFound)
+	mp, err := restored.Get(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	require.NoError(t, err)
+	assert.True(t, counter.Updated.Equal(*mp.Updated))
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+// ErrBucketsMismatch is returned when the received histogram has bucket bounds different from the stored ones.
+var ErrBucketsMismatch = errors.New("histogram buckets do not match")
+
+// validateHistogram function checks that the bounds are finite and ascending and that the bucket counts add up to the count.
+func validateHistogram(h *metrics.HistogramValue) error {
+
+	if h == nil {
+		return ErrWrongType
+	}
+	if len(h.Buckets) != len(h.Bounds)+1 {
+		return fmt.Errorf("%w: %d buckets for %d bounds", ErrWrongType, len(h.Buckets), len(h.Bounds))
+	}
+	for i, bound := range h.Bounds {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return fmt.Errorf("%w: bound %v is not finite", ErrWrongType, bound)
+		}
+		if i > 0 && bound <= h.Bounds[i-1] {
+			return fmt.Errorf("%w: bounds are not ascending", ErrWrongType)
+		}
+	}
+	var count uint64
+	for _, n := range h.Buckets {
+		count += n
+	}
+	if count != h.Count {
+		return fmt.Errorf("%w: bucket counts add up to %d, not %d", ErrWrongType, count, h.Count)
+	}
+	if math.IsNaN(h.Sum) || math.IsInf(h.Sum, 0) {
+		return fmt.Errorf("%w: sum is not finite", ErrWrongType)
+	}
+	return nil
+}
+
+// mergeHistogram function adds the received observations to the stored histogram with the same bounds.
+func mergeHistogram(stored *metrics.HistogramValue, received metrics.HistogramValue) (metrics.HistogramValue, error) {
+
+	if stored == nil {
+		return copyHistogram(received), nil
+	}
+	if !equalBounds(stored.Bounds, received.Bounds) {
+		return received, ErrBucketsMismatch
+	}
+	merged := copyHistogram(*stored)
+	merged.Count += received.Count
+	merged.Sum += received.Sum
+	for i, n := range received.Buckets {
+		merged.Buckets[i] += n
+	}
+	return merged, nil
+}
+
+// copyHistogram function returns a deep copy of the histogram.
+func copyHistogram(h metrics.HistogramValue) metrics.HistogramValue {
+
+	h.Bounds = append([]float64{}, h.Bounds...)
+	h.Buckets = append([]uint64{}, h.Buckets...)
+	return h
+}
+
+// equalBounds function reports whether two histograms have the same buckets.
+func equalBounds(a, b []float64) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
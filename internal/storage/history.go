@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+// HistoryLimit is the maximum number of samples kept per metric by the in-memory history.
+const HistoryLimit = 10000
+
+// ErrHistoryDisabled is returned when the history of system metrics is requested but the history mode is off.
+var ErrHistoryDisabled = errors.New("metrics history is disabled")
+
+// HistoryStorage interface is implemented by the backends that can record every received sample.
+type HistoryStorage interface {
+	// EnableHistory switches on recording of the timestamped samples.
+	EnableHistory()
+	// History returns the samples of the system metric received within the [from, to] interval ordered by time.
+	History(ctx context.Context, mp metrics.Metrics, from, to time.Time) ([]Sample, error)
+}
+
+// Sample struct is a single system metric value received at the specified time.
+// Counter samples keep the received delta rather than the accumulated value.
+type Sample struct {
+	Time  time.Time `json:"time"`
+	Delta *int64    `json:"delta,omitempty"`
+	Value *float64  `json:"value,omitempty"`
+}
+
+// Point struct is the aggregation of samples received within a single step.
+// Gauges are described with min, max, avg and last values, counters with the increase and the per-second rate.
+type Point struct {
+	Time     time.Time `json:"time"`
+	Count    int       `json:"count"`
+	Min      *float64  `json:"min,omitempty"`
+	Max      *float64  `json:"max,omitempty"`
+	Avg      *float64  `json:"avg,omitempty"`
+	Last     *float64  `json:"last,omitempty"`
+	Increase *int64    `json:"increase,omitempty"`
+	Rate     *float64  `json:"rate,omitempty"`
+}
+
+// newSample function copies the value of the received system metric into a new sample.
+func newSample(mp metrics.Metrics, received time.Time) Sample {
+
+	sample := Sample{Time: received}
+	if mp.Delta != nil {
+		delta := *mp.Delta
+		sample.Delta = &delta
+	}
+	if mp.Value != nil {
+		value := *mp.Value
+		sample.Value = &value
+	}
+	return sample
+}
+
+// Aggregate function splits the samples into step-long intervals starting at from
+// and returns a point for every interval that has received samples.
+func Aggregate(mtype string, samples []Sample, from time.Time, step time.Duration) []Point {
+
+	points := []Point{}
+	if step <= 0 {
+		return points
+	}
+	for _, s := range samples {
+		if s.Time.Before(from) {
+			continue
+		}
+		start := from.Add(s.Time.Sub(from) / step * step)
+		if len(points) == 0 || !points[len(points)-1].Time.Equal(start) {
+			points = append(points, Point{Time: start})
+		}
+		p := &points[len(points)-1]
+		p.Count++
+
+		if mtype == metrics.Counter {
+			if s.Delta == nil {
+				continue
+			}
+			increase := *s.Delta
+			if p.Increase != nil {
+				increase += *p.Increase
+			}
+			rate := float64(increase) / step.Seconds()
+			p.Increase, p.Rate = &increase, &rate
+			continue
+		}
+
+		if s.Value == nil {
+			continue
+		}
+		value := *s.Value
+		if p.Last == nil {
+			min, max, avg, last := value, value, value, value
+			p.Min, p.Max, p.Avg, p.Last = &min, &max, &avg, &last
+			continue
+		}
+		if value < *p.Min {
+			*p.Min = value
+		}
+		if value > *p.Max {
+			*p.Max = value
+		}
+		*p.Avg += (value - *p.Avg) / float64(p.Count)
+		*p.Last = value
+	}
+	return points
+}
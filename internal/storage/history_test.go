@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregate(t *testing.T) {
+
+	from := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	gauge := func(offset time.Duration, value float64) Sample {
+		return Sample{Time: from.Add(offset), Value: &value}
+	}
+	counter := func(offset time.Duration, delta int64) Sample {
+		return Sample{Time: from.Add(offset), Delta: &delta}
+	}
+
+	points := Aggregate(metrics.Gauge, []Sample{
+		gauge(10*time.Second, 3),
+		gauge(20*time.Second, 1),
+		gauge(50*time.Second, 5),
+		gauge(130*time.Second, 7),
+	}, from, time.Minute)
+	require.Len(t, points, 2)
+	assert.Equal(t, from, points[0].Time)
+	assert.Equal(t, 3, points[0].Count)
+	assert.Equal(t, 1.0, *points[0].Min)
+	assert.Equal(t, 5.0, *points[0].Max)
+	assert.Equal(t, 3.0, *points[0].Avg)
+	assert.Equal(t, 5.0, *points[0].Last)
+	assert.Equal(t, from.Add(2*time.Minute), points[1].Time)
+	assert.Equal(t, 7.0, *points[1].Last)
+
+	points = Aggregate(metrics.Counter, []Sample{
+		counter(5*time.Second, 10),
+		counter(15*time.Second, 20),
+	}, from, 10*time.Second)
+	require.Len(t, points, 2)
+	assert.Equal(t, int64(10), *points[0].Increase)
+	assert.Equal(t, 1.0, *points[0].Rate)
+	assert.Equal(t, int64(20), *points[1].Increase)
+	assert.Equal(t, 2.0, *points[1].Rate)
+}
+
+func TestMemStorageHistory(t *testing.T) {
+
+	ms := NewMemStorage()
+	ctx := context.Background()
+	value := 1.5
+	gaugeObj := metrics.Metrics{ID: "Alloc", MType: metrics.Gauge, Value: &value}
+
+	_, err := ms.History(ctx, gaugeObj, time.Time{}, time.Now())
+	assert.ErrorIs(t, err, ErrHistoryDisabled)
+
+	ms.EnableHistory()
+	start := time.Now()
+	require.NoError(t, ms.Update(ctx, gaugeObj))
+	value = 2.5
+	require.NoError(t, ms.Update(ctx, gaugeObj))
+
+	samples, err := ms.History(ctx, gaugeObj, start, time.Now())
+	require.NoError(t, err)
+	require.Len(t, samples, 2)
+	assert.Equal(t, 1.5, *samples[0].Value)
+	assert.Equal(t, 2.5, *samples[1].Value)
+
+	samples, err = ms.History(ctx, gaugeObj, time.Now().Add(time.Hour), time.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+}
@@ -0,0 +1,474 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+// MemStorage keeps received system metrics in memory.
+// Gauges, counters and histograms are stored in separate typed maps guarded by RWMutex
+// and keyed by metrics.SeriesKey, so metrics with the same name and different labels are kept apart.
+type MemStorage struct {
+	mu         sync.RWMutex
+	gauges     map[string]float64
+	counters   map[string]int64
+	histograms map[string]metrics.HistogramValue
+	// updated keeps the time of the latest update per type and name.
+	updated map[string]time.Time
+	// history keeps the received samples per type and name when the history mode is enabled.
+	history map[string][]Sample
+}
+
+// memSnapshot struct is used for exporting MemStorage contents to the json-file.
+type memSnapshot struct {
+	Gauges     map[string]float64                `json:"gauges"`
+	Counters   map[string]int64                  `json:"counters"`
+	Histograms map[string]metrics.HistogramValue `json:"histograms,omitempty"`
+	// Updated is keyed by type and name, e.g. gauge/Alloc. Snapshots saved before it was added have no update times.
+	Updated map[string]time.Time `json:"updated,omitempty"`
+}
+
+// memState struct is the copy of the stored system metrics and their history taken before a change that may be rolled back.
+type memState struct {
+	snap    memSnapshot
+	history map[string][]Sample
+}
+
+// NewMemStorage function returns an empty MemStorage object.
+func NewMemStorage() *MemStorage {
+
+	return &MemStorage{
+		gauges:     make(map[string]float64),
+		counters:   make(map[string]int64),
+		histograms: make(map[string]metrics.HistogramValue),
+		updated:    make(map[string]time.Time),
+	}
+}
+
+// Update function updates the metrics container with a received system metric.
+func (ms *MemStorage) Update(ctx context.Context, mp metrics.Metrics) error {
+
+	smp, err := json.Marshal(mp)
+	if err != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", err)
+		return err
+	}
+	log.Print(string(smp))
+
+	if err = validate(mp); err != nil {
+		return err
+	}
+
+	return ms.updateBatch([]metrics.Metrics{mp}, time.Now())
+
+}
+
+// UpdateBatch function updates the metrics container with a slice of received system metrics.
+// The batch is validated as a whole before any of the metrics is applied.
+func (ms *MemStorage) UpdateBatch(ctx context.Context, mb []metrics.Metrics) error {
+
+	for _, mp := range mb {
+		if err := validate(mp); err != nil {
+			return err
+		}
+	}
+
+	return ms.updateBatch(mb, time.Now())
+}
+
+// Get function returns the metric value stored in the metrics container.
+func (ms *MemStorage) Get(ctx context.Context, mp metrics.Metrics) (metrics.Metrics, error) {
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	key := metrics.SeriesKey(mp)
+	switch mp.MType {
+	case metrics.Counter:
+		delta, ok := ms.counters[key]
+		if !ok {
+			return mp, ErrNotFound
+		}
+		mp.Delta = &delta
+	case metrics.Gauge:
+		value, ok := ms.gauges[key]
+		if !ok {
+			return mp, ErrNotFound
+		}
+		mp.Value = &value
+	case metrics.Histogram:
+		h, ok := ms.histograms[key]
+		if !ok {
+			return mp, ErrNotFound
+		}
+		h = copyHistogram(h)
+		mp.Histogram = &h
+	default:
+		return mp, ErrNotFound
+	}
+	mp.Updated = ms.updatedAt(mp.MType, key)
+	return mp, nil
+}
+
+// Delete function removes the system metric and its history from the metrics container.
+func (ms *MemStorage) Delete(ctx context.Context, mp metrics.Metrics) error {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if !ms.delete(mp) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteBatch function removes a slice of system metrics from the metrics container.
+func (ms *MemStorage) DeleteBatch(ctx context.Context, mb []metrics.Metrics) error {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, mp := range mb {
+		ms.delete(mp)
+	}
+	return nil
+}
+
+// Reset function sets the stored counter to zero.
+func (ms *MemStorage) Reset(ctx context.Context, mp metrics.Metrics) error {
+
+	if mp.MType != metrics.Counter {
+		return ErrWrongType
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	key := metrics.SeriesKey(mp)
+	if _, ok := ms.counters[key]; !ok {
+		return ErrNotFound
+	}
+	ms.counters[key] = 0
+	ms.updated[mp.MType+"/"+key] = time.Now()
+	return nil
+}
+
+// List function returns all the metrics stored in the metrics container.
+func (ms *MemStorage) List(ctx context.Context) ([]metrics.Metrics, error) {
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	mb := make([]metrics.Metrics, 0, len(ms.gauges)+len(ms.counters)+len(ms.histograms))
+	for key, value := range ms.gauges {
+		value := value
+		name, labels := metrics.ParseSeriesKey(key)
+		mb = append(mb, metrics.Metrics{ID: name, MType: metrics.Gauge, Value: &value, Labels: labels, Updated: ms.updatedAt(metrics.Gauge, key)})
+	}
+	for key, delta := range ms.counters {
+		delta := delta
+		name, labels := metrics.ParseSeriesKey(key)
+		mb = append(mb, metrics.Metrics{ID: name, MType: metrics.Counter, Delta: &delta, Labels: labels, Updated: ms.updatedAt(metrics.Counter, key)})
+	}
+	for key, h := range ms.histograms {
+		h = copyHistogram(h)
+		name, labels := metrics.ParseSeriesKey(key)
+		mb = append(mb, metrics.Metrics{ID: name, MType: metrics.Histogram, Histogram: &h, Labels: labels, Updated: ms.updatedAt(metrics.Histogram, key)})
+	}
+	return mb, nil
+}
+
+// Expire function removes the gauges that were not updated since the before time and returns the number of removed gauges.
+func (ms *MemStorage) Expire(ctx context.Context, before time.Time) (int, error) {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	expired := ms.expired(before)
+	for _, mp := range expired {
+		ms.delete(mp)
+	}
+	return len(expired), nil
+}
+
+// Ping function always succeeds for the in-memory storage.
+func (ms *MemStorage) Ping(ctx context.Context) error {
+
+	return nil
+}
+
+// Close function has nothing to release for the in-memory storage.
+func (ms *MemStorage) Close() error {
+
+	return nil
+}
+
+// EnableHistory function switches on recording of the received samples.
+func (ms *MemStorage) EnableHistory() {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.history == nil {
+		ms.history = make(map[string][]Sample)
+	}
+}
+
+// History function returns the samples of the system metric received within the [from, to] interval.
+// Only the latest HistoryLimit samples are kept for every metric.
+func (ms *MemStorage) History(ctx context.Context, mp metrics.Metrics, from, to time.Time) ([]Sample, error) {
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if ms.history == nil {
+		return nil, ErrHistoryDisabled
+	}
+	samples := ms.history[mp.MType+"/"+metrics.SeriesKey(mp)]
+	first := sort.Search(len(samples), func(i int) bool { return !samples[i].Time.Before(from) })
+	last := sort.Search(len(samples), func(i int) bool { return samples[i].Time.After(to) })
+	if first >= last {
+		return []Sample{}, nil
+	}
+	return append([]Sample{}, samples[first:last]...), nil
+}
+
+// updateBatch function applies a slice of validated system metrics received at the specified time.
+func (ms *MemStorage) updateBatch(mb []metrics.Metrics, received time.Time) error {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if err := ms.checkBounds(mb); err != nil {
+		return err
+	}
+	for _, mp := range mb {
+		ms.update(mp, received)
+	}
+	return nil
+}
+
+// update function applies a validated system metric to the typed maps. The caller must hold the lock.
+// Histogram bounds must be checked with checkBounds beforehand, histograms have no history.
+func (ms *MemStorage) update(mp metrics.Metrics, received time.Time) {
+
+	key := metrics.SeriesKey(mp)
+	ms.updated[mp.MType+"/"+key] = received
+	if mp.MType == metrics.Histogram {
+		var stored *metrics.HistogramValue
+		if h, ok := ms.histograms[key]; ok {
+			stored = &h
+		}
+		ms.histograms[key], _ = mergeHistogram(stored, *mp.Histogram)
+		return
+	}
+
+	if ms.history != nil {
+		historyKey := mp.MType + "/" + key
+		samples := append(ms.history[historyKey], newSample(mp, received))
+		if len(samples) > HistoryLimit {
+			samples = samples[len(samples)-HistoryLimit:]
+		}
+		ms.history[historyKey] = samples
+	}
+
+	if mp.MType == metrics.Counter {
+		ms.counters[key] += *mp.Delta
+		return
+	}
+	ms.gauges[key] = *mp.Value
+}
+
+// delete function removes the system metric and reports whether it was stored. The caller must hold the lock.
+func (ms *MemStorage) delete(mp metrics.Metrics) bool {
+
+	var ok bool
+	key := metrics.SeriesKey(mp)
+	switch mp.MType {
+	case metrics.Counter:
+		_, ok = ms.counters[key]
+		delete(ms.counters, key)
+	case metrics.Gauge:
+		_, ok = ms.gauges[key]
+		delete(ms.gauges, key)
+	case metrics.Histogram:
+		_, ok = ms.histograms[key]
+		delete(ms.histograms, key)
+	}
+	delete(ms.updated, mp.MType+"/"+key)
+	if ms.history != nil {
+		delete(ms.history, mp.MType+"/"+key)
+	}
+	return ok
+}
+
+// expired function returns the gauges that were not updated since the before time. The caller must hold the lock.
+func (ms *MemStorage) expired(before time.Time) []metrics.Metrics {
+
+	var mb []metrics.Metrics
+	for key := range ms.gauges {
+		if updated, ok := ms.updated[metrics.Gauge+"/"+key]; ok && updated.Before(before) {
+			name, labels := metrics.ParseSeriesKey(key)
+			mb = append(mb, metrics.Metrics{ID: name, MType: metrics.Gauge, Labels: labels})
+		}
+	}
+	return mb
+}
+
+// updatedAt function returns the time of the latest update of the system metric. The caller must hold the lock.
+func (ms *MemStorage) updatedAt(mtype, key string) *time.Time {
+
+	updated, ok := ms.updated[mtype+"/"+key]
+	if !ok {
+		return nil
+	}
+	return &updated
+}
+
+// checkBounds function verifies that the received histograms have the bounds of the stored ones and of each other.
+// The caller must hold the lock.
+func (ms *MemStorage) checkBounds(mb []metrics.Metrics) error {
+
+	bounds := make(map[string][]float64)
+	for _, mp := range mb {
+		if mp.MType != metrics.Histogram {
+			continue
+		}
+		key := metrics.SeriesKey(mp)
+		known, ok := bounds[key]
+		if !ok {
+			stored, found := ms.histograms[key]
+			known, ok = stored.Bounds, found
+		}
+		if ok && !equalBounds(known, mp.Histogram.Bounds) {
+			return ErrBucketsMismatch
+		}
+		bounds[key] = mp.Histogram.Bounds
+	}
+	return nil
+}
+
+// snapshot function returns a copy of the stored system metrics.
+func (ms *MemStorage) snapshot() memSnapshot {
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	snap := memSnapshot{
+		Gauges:     make(map[string]float64, len(ms.gauges)),
+		Counters:   make(map[string]int64, len(ms.counters)),
+		Histograms: make(map[string]metrics.HistogramValue, len(ms.histograms)),
+		Updated:    make(map[string]time.Time, len(ms.updated)),
+	}
+	for name, value := range ms.gauges {
+		snap.Gauges[name] = value
+	}
+	for name, delta := range ms.counters {
+		snap.Counters[name] = delta
+	}
+	for name, h := range ms.histograms {
+		snap.Histograms[name] = copyHistogram(h)
+	}
+	for name, updated := range ms.updated {
+		snap.Updated[name] = updated
+	}
+	return snap
+}
+
+// state function returns a copy of the stored system metrics and their history.
+func (ms *MemStorage) state() memState {
+
+	st := memState{snap: ms.snapshot()}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.history != nil {
+		st.history = make(map[string][]Sample, len(ms.history))
+		for key, samples := range ms.history {
+			st.history[key] = append([]Sample(nil), samples...)
+		}
+	}
+	return st
+}
+
+// rollback function replaces the stored system metrics and their history with the copy returned by state.
+func (ms *MemStorage) rollback(st memState) {
+
+	ms.restore(st.snap)
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.history != nil {
+		ms.history = st.history
+	}
+}
+
+// restore function replaces the stored system metrics with the snapshot contents.
+// Metrics without the update time in the snapshot are treated as updated on restore.
+func (ms *MemStorage) restore(snap memSnapshot) {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.gauges = make(map[string]float64, len(snap.Gauges))
+	ms.counters = make(map[string]int64, len(snap.Counters))
+	for name, value := range snap.Gauges {
+		ms.gauges[name] = value
+	}
+	for name, delta := range snap.Counters {
+		ms.counters[name] = delta
+	}
+	ms.histograms = make(map[string]metrics.HistogramValue, len(snap.Histograms))
+	for name, h := range snap.Histograms {
+		ms.histograms[name] = copyHistogram(h)
+	}
+
+	restored := time.Now()
+	ms.updated = make(map[string]time.Time, len(snap.Updated))
+	restoreUpdated := func(typedKey string) {
+		updated, ok := snap.Updated[typedKey]
+		if !ok {
+			updated = restored
+		}
+		ms.updated[typedKey] = updated
+	}
+	for key := range ms.gauges {
+		restoreUpdated(metrics.Gauge + "/" + key)
+	}
+	for key := range ms.counters {
+		restoreUpdated(metrics.Counter + "/" + key)
+	}
+	for key := range ms.histograms {
+		restoreUpdated(metrics.Histogram + "/" + key)
+	}
+}
+
+// validate function checks that the system metric has a valid name and labels, a supported type and carries the matching value.
+func validate(mp metrics.Metrics) error {
+
+	if !metrics.ValidName(mp.ID) {
+		return fmt.Errorf("%w: invalid name %q", ErrWrongType, mp.ID)
+	}
+	for name := range mp.Labels {
+		if !metrics.ValidLabelName(name) {
+			return fmt.Errorf("%w: invalid label name %q", ErrWrongType, name)
+		}
+	}
+	switch mp.MType {
+	case metrics.Counter:
+		if mp.Delta == nil {
+			return ErrWrongType
+		}
+	case metrics.Gauge:
+		if mp.Value == nil {
+			return ErrWrongType
+		}
+	case metrics.Histogram:
+		if _, ok := mp.Labels[metrics.BucketLabel]; ok {
+			return fmt.Errorf("%w: label %q is reserved for histogram buckets", ErrWrongType, metrics.BucketLabel)
+		}
+		return validateHistogram(mp.Histogram)
+	default:
+		return ErrWrongType
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemStorageConcurrentUpdate(t *testing.T) {
+
+	ms := NewMemStorage()
+	ctx := context.Background()
+	delta := int64(1)
+	value := 2.5
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, ms.Update(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter, Delta: &delta}))
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, ms.UpdateBatch(ctx, []metrics.Metrics{
+				{ID: "PollCount", MType: metrics.Counter, Delta: &delta},
+				{ID: "Alloc", MType: metrics.Gauge, Value: &value},
+			}))
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := ms.List(ctx)
+			assert.NoError(t, err)
+			_ = ms.snapshot()
+		}()
+	}
+	wg.Wait()
+
+	mp, err := ms.Get(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), *mp.Delta)
+}
+
+func TestMemStorageUpdateBatchValidation(t *testing.T) {
+
+	ms := NewMemStorage()
+	ctx := context.Background()
+	delta := int64(3)
+
+	err := ms.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "PollCount", MType: metrics.Counter, Delta: &delta},
+		{ID: "Alloc", MType: metrics.Gauge},
+	})
+	assert.ErrorIs(t, err, ErrWrongType)
+
+	_, err = ms.Get(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+// testDeleteReset function checks the delete and reset operations of a storage backend.
+func testDeleteReset(t *testing.T, st Storage) {
+
+	ctx := context.Background()
+	delta := int64(5)
+	value := 1.5
+	require.NoError(t, st.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "PollCount", MType: metrics.Counter, Delta: &delta},
+		{ID: "Alloc", MType: metrics.Gauge, Value: &value},
+		{ID: "Frees", MType: metrics.Gauge, Value: &value},
+		{ID: "Stale", MType: metrics.Counter, Delta: &delta},
+	}))
+
+	require.NoError(t, st.Reset(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter}))
+	mp, err := st.Get(ctx, metrics.Metrics{ID: "PollCount", MType: metrics.Counter})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), *mp.Delta)
+	assert.ErrorIs(t, st.Reset(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge}), ErrWrongType)
+	assert.ErrorIs(t, st.Reset(ctx, metrics.Metrics{ID: "Missing", MType: metrics.Counter}), ErrNotFound)
+
+	require.NoError(t, st.Delete(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge}))
+	assert.ErrorIs(t, st.Delete(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge}), ErrNotFound)
+	_, err = st.Get(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, st.DeleteBatch(ctx, []metrics.Metrics{
+		{ID: "Frees", MType: metrics.Gauge},
+		{ID: "Stale", MType: metrics.Counter},
+		{ID: "Missing", MType: metrics.Gauge},
+	}))
+	mb, err := st.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, mb, 1)
+	assert.Equal(t, "PollCount", mb[0].ID)
+}
+
+func TestMemStorageDeleteReset(t *testing.T) {
+
+	testDeleteReset(t, NewMemStorage())
+}
+
+// testHistogram function checks that a storage backend merges and returns histogram metrics.
+func testHistogram(t *testing.T, st Storage) {
+
+	ctx := context.Background()
+	observed := func(sum float64, buckets ...uint64) metrics.Metrics {
+		h := metrics.HistogramValue{Sum: sum, Bounds: []float64{0.1, 0.5}, Buckets: buckets}
+		for _, n := range buckets {
+			h.Count += n
+		}
+		return metrics.Metrics{ID: "Latency", MType: metrics.Histogram, Histogram: &h}
+	}
+
+	require.NoError(t, st.Update(ctx, observed(0.3, 1, 1, 0)))
+	require.NoError(t, st.UpdateBatch(ctx, []metrics.Metrics{observed(1.2, 0, 1, 1), observed(0.05, 1, 0, 0)}))
+
+	mp, err := st.Get(ctx, metrics.Metrics{ID: "Latency", MType: metrics.Histogram})
+	require.NoError(t, err)
+	require.NotNil(t, mp.Histogram)
+	assert.Equal(t, uint64(5), mp.Histogram.Count)
+	assert.InDelta(t, 1.55, mp.Histogram.Sum, 1e-9)
+	assert.Equal(t, []uint64{2, 2, 1}, mp.Histogram.Buckets)
+
+	other := observed(1, 1, 0, 0)
+	other.Histogram.Bounds = []float64{1, 2}
+	assert.ErrorIs(t, st.Update(ctx, other), ErrBucketsMismatch)
+	invalid := observed(1, 1, 0, 0)
+	invalid.Histogram.Count = 5
+	assert.ErrorIs(t, st.Update(ctx, invalid), ErrWrongType)
+	bucketLabel := observed(1, 1, 0, 0)
+	bucketLabel.Labels = map[string]string{metrics.BucketLabel: "1"}
+	assert.ErrorIs(t, st.Update(ctx, bucketLabel), ErrWrongType)
+
+	mp, err = st.Get(ctx, metrics.Metrics{ID: "Latency", MType: metrics.Histogram})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), mp.Histogram.Count)
+}
+
+func TestMemStorageHistogram(t *testing.T) {
+
+	testHistogram(t, NewMemStorage())
+}
+
+// testLabels function checks that a storage backend keeps metrics with different labels apart.
+func testLabels(t *testing.T, st Storage) {
+
+	ctx := context.Background()
+	value := func(v float64) *float64 { return &v }
+	hostA := map[string]string{"host": "a", "zone": "eu"}
+	hostB := map[string]string{"host": "b", "zone": "eu"}
+	require.NoError(t, st.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "Alloc", MType: metrics.Gauge, Value: value(1)},
+		{ID: "Alloc", MType: metrics.Gauge, Value: value(2), Labels: hostA},
+		{ID: "Alloc", MType: metrics.Gauge, Value: value(3), Labels: hostB},
+	}))
+	assert.ErrorIs(t, st.Update(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge, Value: value(4),
+		Labels: map[string]string{"bad-name": "x"}}), ErrWrongType)
+	// the name with braces would share the series key with the labeled metric
+	assert.ErrorIs(t, st.Update(ctx, metrics.Metrics{ID: `Alloc{host="a",zone="eu"}`, MType: metrics.Gauge, Value: value(4)}), ErrWrongType)
+
+	mp, err := st.Get(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge, Labels: map[string]string{"zone": "eu", "host": "b"}})
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, *mp.Value)
+	mp, err = st.Get(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge})
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, *mp.Value)
+	_, err = st.Get(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge, Labels: map[string]string{"host": "a"}})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, st.Delete(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge, Labels: hostA}))
+	mb, err := st.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, mb, 2)
+	for _, mp := range mb {
+		if *mp.Value == 3 {
+			assert.Equal(t, hostB, mp.Labels)
+		} else {
+			assert.Empty(t, mp.Labels)
+		}
+	}
+}
+
+func TestMemStorageLabels(t *testing.T) {
+
+	testLabels(t, NewMemStorage())
+}
+
+// testExpire function checks the update times and the removal of the stale gauges of a storage backend.
+func testExpire(t *testing.T, st Storage) {
+
+	ctx := context.Background()
+	value := 1.5
+	delta := int64(2)
+	started := time.Now()
+	require.NoError(t, st.UpdateBatch(ctx, []metrics.Metrics{
+		{ID: "Alloc", MType: metrics.Gauge, Value: &value},
+		{ID: "PollCount", MType: metrics.Counter, Delta: &delta},
+	}))
+
+	mp, err := st.Get(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge})
+	require.NoError(t, err)
+	require.NotNil(t, mp.Updated)
+	assert.WithinDuration(t, started, *mp.Updated, time.Minute)
+
+	expired, err := st.Expire(ctx, started.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Zero(t, expired)
+
+	// counters are never expired
+	expired, err = st.Expire(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	_, err = st.Get(ctx, metrics.Metrics{ID: "Alloc", MType: metrics.Gauge})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	mb, err := st.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, mb, 1)
+	assert.Equal(t, metrics.Counter, mb[0].MType)
+	require.NotNil(t, mb[0].Updated)
+	assert.WithinDuration(t, started, *mb[0].Updated, time.Minute)
+}
+
+func TestMemStorageExpire(t *testing.T) {
+
+	testExpire(t, NewMemStorage())
+}
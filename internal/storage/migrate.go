@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations
+var migrationsFS embed.FS
+
+// migrationLockID is the key of the Postgres advisory lock held for the whole migration run.
+const migrationLockID int64 = 7263548120
+
+// dbConn interface is the part of *sql.DB and *sql.Conn used to apply the migrations.
+type dbConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// Migration struct describes a single versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// LoadMigrations function reads up migrations named as <version>_<name>.up.sql from the directory
+// and returns them ordered by version.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(fileName, ".up.sql") {
+			continue
+		}
+		versionPart, name, ok := strings.Cut(strings.TrimSuffix(fileName, ".up.sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: missing name", fileName)
+		}
+		version, err := strconv.Atoi(versionPart)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: invalid version", fileName)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migration %s: version %d already used by %s", fileName, version, other)
+		}
+		seen[version] = fileName
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(data)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// PendingMigrations function returns the migrations that have not been applied to the database yet.
+// The database is not modified.
+func PendingMigrations(ctx context.Context, db *sql.DB, d Dialect, migrations []Migration) ([]Migration, error) {
+
+	return pendingMigrations(ctx, db, d, migrations)
+}
+
+// pendingMigrations function reads the schema version on the connection and returns the migrations above it.
+func pendingMigrations(ctx context.Context, db dbConn, d Dialect, migrations []Migration) ([]Migration, error) {
+
+	var exists bool
+	err := db.QueryRowContext(ctx, d.versionTableQuery).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return migrations, nil
+	}
+
+	var current int
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version;").Scan(&current)
+	if err != nil {
+		return nil, err
+	}
+	return pendingAfter(migrations, current), nil
+}
+
+// Migrate function applies pending migrations in version order. Every migration runs in its own transaction
+// together with the schema_version record, so a failed migration leaves the schema at the previous version.
+// On Postgres the whole run holds an advisory lock, so the servers started together against the same database
+// wait for each other and apply every migration once.
+func Migrate(ctx context.Context, db *sql.DB, d Dialect, migrations []Migration) error {
+
+	// advisory locks belong to the database session, the run uses a single connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		log.Printf("Error happened when acquiring connection for migrations. Err: %s", err)
+		return err
+	}
+	defer conn.Close()
+
+	if d.lockMigrations != "" {
+		if _, err = conn.ExecContext(ctx, d.lockMigrations, migrationLockID); err != nil {
+			log.Printf("Error happened when locking migrations. Err: %s", err)
+			return err
+		}
+		defer unlockMigrations(conn, d)
+	}
+
+	_, err = conn.ExecContext(ctx, d.createVersionTable)
+	if err != nil {
+		log.Printf("Error happened when creating schema_version table. Err: %s", err)
+		return err
+	}
+
+	// the schema version is read under the lock, so the migrations applied by another server are not repeated
+	pending, err := pendingMigrations(ctx, conn, d, migrations)
+	if err != nil {
+		log.Printf("Error happened when reading schema version. Err: %s", err)
+		return err
+	}
+
+	for _, m := range pending {
+		if err = applyMigration(ctx, conn, m); err != nil {
+			log.Printf("Error happened when applying migration %04d_%s. Err: %s", m.Version, m.Name, err)
+			return err
+		}
+		log.Printf("applied migration %04d_%s", m.Version, m.Name)
+	}
+	return nil
+}
+
+// unlockMigrations function releases the migrations lock. The context of the run may be already cancelled,
+// so the lock is released without it. When the release fails the connection is discarded instead of
+// returning to the pool, which ends the session and the lock with it.
+func unlockMigrations(conn *sql.Conn, d Dialect) {
+
+	if _, err := conn.ExecContext(context.Background(), d.unlockMigrations, migrationLockID); err != nil {
+		log.Printf("Error happened when unlocking migrations. Err: %s", err)
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+}
+
+// applyMigration function executes a single migration and records its version.
+func applyMigration(ctx context.Context, db dbConn, m Migration) error {
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, m.SQL); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "INSERT INTO schema_version (version, name) VALUES ($1, $2);", m.Version, m.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// pendingAfter function returns the migrations with versions above the current one.
+func pendingAfter(migrations []Migration, current int) []Migration {
+
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
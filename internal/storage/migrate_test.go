@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		fsys     fstest.MapFS
+		versions []int
+		wantErr  bool
+	}{
+		{
+			name: "ordered by version",
+			fsys: fstest.MapFS{
+				"m/0010_add_index.up.sql":    {Data: []byte("CREATE INDEX;")},
+				"m/0002_add_column.up.sql":   {Data: []byte("ALTER TABLE;")},
+				"m/0001_create_table.up.sql": {Data: []byte("CREATE TABLE;")},
+				"m/README.md":                {Data: []byte("notes")},
+			},
+			versions: []int{1, 2, 10},
+		},
+		{
+			name: "duplicate version",
+			fsys: fstest.MapFS{
+				"m/0001_create_table.up.sql": {Data: []byte("CREATE TABLE;")},
+				"m/0001_add_column.up.sql":   {Data: []byte("ALTER TABLE;")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid version",
+			fsys: fstest.MapFS{
+				"m/first_create_table.up.sql": {Data: []byte("CREATE TABLE;")},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := LoadMigrations(tt.fsys, "m")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			versions := []int{}
+			for _, m := range migrations {
+				versions = append(versions, m.Version)
+			}
+			assert.Equal(t, tt.versions, versions)
+		})
+	}
+}
+
+func TestDialectMigrations(t *testing.T) {
+
+	for _, d := range []Dialect{Postgres, SQLite} {
+		migrations, err := d.Migrations()
+		require.NoError(t, err)
+		require.NotEmpty(t, migrations)
+		for i, m := range migrations {
+			assert.Equal(t, i+1, m.Version)
+			assert.NotEmpty(t, m.SQL)
+		}
+	}
+
+	migrations, err := Postgres.Migrations()
+	require.NoError(t, err)
+
+	pending := pendingAfter(migrations, 1)
+	assert.Len(t, pending, len(migrations)-1)
+	assert.Equal(t, 2, pending[0].Version)
+}
+
+func TestMigrateLocked(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	db, d, err := openDB(SQLitePrefix + filepath.Join(t.TempDir(), "metrics.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// the lock statements run on the connection of the migrations, which is the only one in the SQLite pool
+	d.lockMigrations = "SELECT $1;"
+	d.unlockMigrations = "SELECT $1;"
+	migrations, err := d.Migrations()
+	require.NoError(t, err)
+	require.NoError(t, Migrate(ctx, db, d, migrations))
+
+	pending, err := PendingMigrations(ctx, db, d, migrations)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
@@ -0,0 +1,7 @@
+-- Append-only metrics table created by the first server releases.
+CREATE TABLE IF NOT EXISTS metrics (
+    metrics_id int GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    name text NOT NULL,
+    delta bigint,
+    value double precision
+);
@@ -0,0 +1,22 @@
+-- Convert the append-only metrics table to a single row per metric keyed by name and type.
+-- Gauges keep the latest recorded value, counters keep the sum of all recorded deltas.
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_schema = current_schema() AND table_name = 'metrics' AND column_name = 'metrics_id') THEN
+        ALTER TABLE metrics ADD COLUMN IF NOT EXISTS type text;
+        UPDATE metrics SET type = CASE WHEN value IS NULL THEN 'counter' ELSE 'gauge' END WHERE type IS NULL;
+        ALTER TABLE metrics RENAME TO metrics_legacy;
+        CREATE TABLE metrics (
+            name text NOT NULL,
+            type text NOT NULL,
+            delta bigint,
+            value double precision,
+            PRIMARY KEY (name, type)
+        );
+        INSERT INTO metrics (name, type, delta, value)
+            SELECT name, type, SUM(delta), (ARRAY_AGG(value ORDER BY metrics_id DESC))[1]
+            FROM metrics_legacy GROUP BY name, type;
+        DROP TABLE metrics_legacy;
+    END IF;
+END $$;
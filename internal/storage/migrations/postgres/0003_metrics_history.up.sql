@@ -0,0 +1,9 @@
+-- Timestamped samples recorded when the server runs in the history mode.
+CREATE TABLE IF NOT EXISTS metrics_history (
+    name text NOT NULL,
+    type text NOT NULL,
+    delta bigint,
+    value double precision,
+    recorded_at timestamptz NOT NULL
+);
+CREATE INDEX IF NOT EXISTS metrics_history_name_type_recorded_at ON metrics_history (name, type, recorded_at);
@@ -0,0 +1,15 @@
+-- Metrics are keyed by name, type and the canonical labels string, which is empty for metrics without labels.
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels text NOT NULL DEFAULT '';
+DO $$
+DECLARE
+    pk text;
+BEGIN
+    SELECT conname INTO pk FROM pg_constraint WHERE conrelid = 'metrics'::regclass AND contype = 'p';
+    IF pk IS NOT NULL THEN
+        EXECUTE format('ALTER TABLE metrics DROP CONSTRAINT %I', pk);
+    END IF;
+END $$;
+ALTER TABLE metrics ADD PRIMARY KEY (name, type, labels);
+ALTER TABLE metrics_history ADD COLUMN IF NOT EXISTS labels text NOT NULL DEFAULT '';
+DROP INDEX IF EXISTS metrics_history_name_type_recorded_at;
+CREATE INDEX IF NOT EXISTS metrics_history_series_recorded_at ON metrics_history (name, type, labels, recorded_at);
@@ -0,0 +1,3 @@
+-- The time of the latest update is used to detect the gauges of the agents that stopped reporting.
+-- The stored metrics are treated as updated when the migration is applied.
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
@@ -0,0 +1,8 @@
+-- Bearer tokens issued to the agents and the users, only the hashes of the secrets are stored.
+CREATE TABLE IF NOT EXISTS tokens (
+    id text PRIMARY KEY,
+    name text NOT NULL,
+    scopes text NOT NULL,
+    hash text NOT NULL UNIQUE,
+    created_at timestamptz NOT NULL
+);
@@ -0,0 +1,2 @@
+-- The agent instance the token writes the metrics of, empty for the tokens not bound to an instance.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS instance text NOT NULL DEFAULT '';
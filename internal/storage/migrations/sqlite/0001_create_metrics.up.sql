@@ -0,0 +1,8 @@
+-- Single row per metric keyed by name and type.
+CREATE TABLE IF NOT EXISTS metrics (
+    name text NOT NULL,
+    type text NOT NULL,
+    delta integer,
+    value real,
+    PRIMARY KEY (name, type)
+);
@@ -0,0 +1,10 @@
+-- Timestamped samples recorded when the server runs in the history mode.
+-- recorded_at keeps unix nanoseconds.
+CREATE TABLE IF NOT EXISTS metrics_history (
+    name text NOT NULL,
+    type text NOT NULL,
+    delta integer,
+    value real,
+    recorded_at integer NOT NULL
+);
+CREATE INDEX IF NOT EXISTS metrics_history_name_type_recorded_at ON metrics_history (name, type, recorded_at);
@@ -0,0 +1,2 @@
+-- Histogram metrics keep their count, sum and buckets json-encoded.
+ALTER TABLE metrics ADD COLUMN histogram text;
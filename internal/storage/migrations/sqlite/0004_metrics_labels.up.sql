@@ -0,0 +1,17 @@
+-- Metrics are keyed by name, type and the canonical labels string, which is empty for metrics without labels.
+-- SQLite cannot change the primary key in place, so the table is rebuilt.
+CREATE TABLE metrics_labeled (
+    name text NOT NULL,
+    type text NOT NULL,
+    labels text NOT NULL DEFAULT '',
+    delta integer,
+    value real,
+    histogram text,
+    PRIMARY KEY (name, type, labels)
+);
+INSERT INTO metrics_labeled (name, type, delta, value, histogram) SELECT name, type, delta, value, histogram FROM metrics;
+DROP TABLE metrics;
+ALTER TABLE metrics_labeled RENAME TO metrics;
+ALTER TABLE metrics_history ADD COLUMN labels text NOT NULL DEFAULT '';
+DROP INDEX IF EXISTS metrics_history_name_type_recorded_at;
+CREATE INDEX IF NOT EXISTS metrics_history_series_recorded_at ON metrics_history (name, type, labels, recorded_at);
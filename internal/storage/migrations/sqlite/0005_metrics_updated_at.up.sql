@@ -0,0 +1,4 @@
+-- The time of the latest update in unix nanoseconds is used to detect the gauges of the agents that stopped reporting.
+-- The stored metrics are treated as updated when the migration is applied.
+ALTER TABLE metrics ADD COLUMN updated_at integer NOT NULL DEFAULT 0;
+UPDATE metrics SET updated_at = CAST(strftime('%s', 'now') AS integer) * 1000000000;
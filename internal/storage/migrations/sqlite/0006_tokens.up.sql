@@ -0,0 +1,9 @@
+-- Bearer tokens issued to the agents and the users, only the hashes of the secrets are stored.
+-- The creation time is stored in unix nanoseconds.
+CREATE TABLE IF NOT EXISTS tokens (
+    id text PRIMARY KEY,
+    name text NOT NULL,
+    scopes text NOT NULL,
+    hash text NOT NULL UNIQUE,
+    created_at integer NOT NULL
+);
@@ -4,320 +4,124 @@
 package storage
 
 import (
-	"bufio"
 	"context"
-	"database/sql"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
-	"os"
-	"reflect"
-	"strings"
 	"time"
 
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/config"
 	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
-	_ "github.com/lib/pq"
 )
 
-var err error
+// ErrNotFound is returned when the requested system metric was never recorded to the storage.
+var ErrNotFound = errors.New("metrics not found")
+
+// ErrWrongType is returned when the received system metric has an unsupported type or misses its value.
+var ErrWrongType = errors.New("wrong metrics type")
+
+// ErrAmbiguous is returned by Resolve when the metric requested without labels is stored with several label sets.
+var ErrAmbiguous = errors.New("metrics requested without labels match several series")
+
+// Storage interface describes the operations supported by every system metrics backend.
+type Storage interface {
+	// Update saves a single system metric. Counter values are added to the stored ones, gauge values replace them.
+	Update(ctx context.Context, mp metrics.Metrics) error
+	// UpdateBatch saves a slice of system metrics in a single operation.
+	UpdateBatch(ctx context.Context, mb []metrics.Metrics) error
+	// Get returns the stored value of the requested system metric or ErrNotFound.
+	Get(ctx context.Context, mp metrics.Metrics) (metrics.Metrics, error)
+	// Delete removes the stored system metric or returns ErrNotFound.
+	Delete(ctx context.Context, mp metrics.Metrics) error
+	// DeleteBatch removes a slice of system metrics in a single operation, metrics that are not stored are skipped.
+	DeleteBatch(ctx context.Context, mb []metrics.Metrics) error
+	// Reset sets the stored counter to zero. ErrWrongType is returned for gauges, ErrNotFound for unknown counters.
+	Reset(ctx context.Context, mp metrics.Metrics) error
+	// Expire removes the gauges that were not updated since the before time and returns the number of removed gauges.
+	Expire(ctx context.Context, before time.Time) (int, error)
+	// List returns all stored system metrics with the time of their latest update.
+	List(ctx context.Context) ([]metrics.Metrics, error)
+	// Ping checks that the storage is available.
+	Ping(ctx context.Context) error
+	// Close releases the storage resources.
+	Close() error
+}
 
-// RepositoryUpdate function saves received system metrics to a SQL database if it is enabled
-// or updates metrics container that is later exported to the json-file.
-func RepositoryUpdate(mp metrics.Metrics, storeDB *sql.DB, dbFlag bool, ctx context.Context) error {
+// Resolve function returns the stored value of the requested system metric. A metric requested without labels
+// that is stored only with labels, e.g. with the instance label attached by the agent, resolves to its single series.
+// ErrAmbiguous is returned when there are several series with the name and type.
+func Resolve(ctx context.Context, st Storage, mp metrics.Metrics) (metrics.Metrics, error) {
 
-	smp, err := json.Marshal(mp)
-	if err != nil {
-		log.Printf("Error happened in JSON marshal. Err: %s", err)
-		return err
+	found, err := st.Get(ctx, mp)
+	if !errors.Is(err, ErrNotFound) || len(mp.Labels) > 0 {
+		return found, err
 	}
-	log.Print(string(smp))
-
-	if dbFlag {
-		err = DBSave(storeDB, mp, ctx)
-		if err != nil {
-			log.Printf("Error happened in updating database. Err: %s", err)
-			return err
-		}
-		return nil
+	metricsList, err := st.List(ctx)
+	if err != nil {
+		return found, err
 	}
-	v := reflect.ValueOf(mp)
-	var newValue float64
-	var newDelta int64
-	var oldDelta int64
-
-	fieldName := v.Field(0).Interface().(string)
-	fieldType := v.Field(1).Interface().(string)
-
-	if fieldType != metrics.Counter {
-		newValue = *mp.Value
-		log.Printf("New gauge %f\n", newValue)
-		if metrics.Container != nil {
-			metrics.Container[fieldName] = newValue
+	var matched []metrics.Metrics
+	for _, stored := range metricsList {
+		if stored.ID == mp.ID && stored.MType == mp.MType {
+			matched = append(matched, stored)
 		}
-		return nil
 	}
-	newDelta = *mp.Delta
-	log.Printf("New counter %d\n", newDelta)
-	if _, ok := metrics.Container[fieldName]; ok {
-		if _, ok := metrics.Container[fieldName].(float64); ok {
-			valOld, ok := metrics.Container[fieldName].(float64)
-			if !ok {
-				err = errors.New("failed metrics retrieval")
-				log.Printf("Error happened in reading metrics from loaded storage. Metrics: %s Err: %s", fieldName, err)
-				return err
-			}
-			oldDelta = int64(valOld)
-		} else {
-			oldDelta, ok = metrics.Container[fieldName].(int64)
-			if !ok {
-				err = errors.New("failed metrics retrieval")
-				log.Printf("Error happened in reading container metrics. Metrics: %s Err: %s", fieldName, err)
-				return err
-			}
-		}
-		newDelta = oldDelta + newDelta
+	switch len(matched) {
+	case 0:
+		return found, ErrNotFound
+	case 1:
+		return matched[0], nil
 	}
-	metrics.Container[fieldName] = newDelta
-	return nil
-
+	return found, ErrAmbiguous
 }
 
-// RepositoryRetrieve function gets metric values from the storage upon request
-// and returns it in a struct format.
-func RepositoryRetrieve(mp metrics.Metrics, storeDB *sql.DB, dbFlag bool, ctx context.Context) (metrics.Metrics, error) {
-
-	if dbFlag {
-		return DBUpload(storeDB, mp, ctx)
-	}
-
-	v := reflect.ValueOf(mp)
-	var delta int64
-
-	fieldName, ok := v.Field(0).Interface().(string)
-	if !ok {
-		err = errors.New("failed metrics retrieval")
-		log.Printf("Error happened in validating metrics name. Err: %s", err)
-		return mp, err
-	}
-	fieldType, ok := v.Field(1).Interface().(string)
-	if !ok {
-		err = errors.New("failed metrics retrieval")
-		log.Printf("Error happened in validating metrics type. Err: %s", err)
-		return mp, err
-	}
+// ContainerUpdate function enables saving received system metrics to a json-file constantly at regular intervals.
+// Nothing is done for non-positive intervals, the synchronous saving is enabled with FileStorage.EnableSyncSave instead.
+func ContainerUpdate(storeInterval time.Duration, fs *FileStorage) {
 
-	if fieldType == metrics.Counter {
-		if _, ok := metrics.Container[fieldName].(float64); ok {
-			valOld := metrics.Container[fieldName].(float64)
-			delta = int64(valOld)
-		} else {
-			delta = metrics.Container[fieldName].(int64)
-		}
-		mp.Delta = &delta
-	} else {
-		value := metrics.Container[fieldName].(float64)
-		mp.Value = &value
+	if storeInterval <= 0 {
+		return
 	}
-	return mp, nil
+	ticker := time.NewTicker(storeInterval)
+	defer ticker.Stop()
 
-}
-
-// RepositoryRetrieve function gets metric values from the storage upon request
-// and returns it in a string format.
-func RepositoryRetrieveString(mp metrics.Metrics, storeDB *sql.DB, dbFlag bool, ctx context.Context) (string, error) {
-
-	var requestedValue string
-	if dbFlag {
-		mp, err = DBUpload(storeDB, mp, ctx)
-		if err != nil {
-			log.Printf("Error happened in retrieveing metrics. Err: %s", err)
-			return requestedValue, err
-		}
+	for range ticker.C {
 
-		if mp.Delta != nil {
-			requestedValue = fmt.Sprintf("%v", mp.Delta)
-			return requestedValue, err
-		} else {
-			return fmt.Sprintf("%v", mp.Value), err
+		if err := fs.Compact(); err != nil {
+			log.Printf("Error happened in saving metrics to the json-file. Err: %s", err)
 		}
-	}
 
-	v := reflect.ValueOf(mp)
-	fieldName, ok := v.Field(0).Interface().(string)
-	if !ok {
-		err = errors.New("failed metrics retrieval")
-		log.Printf("Error happened in validating metrics name. Err: %s", err)
-		return requestedValue, err
 	}
-	requestedValue = fmt.Sprintf("%v", metrics.Container[fieldName])
-	return requestedValue, nil
 
 }
 
-// StaticFileSave function saves received system metrics to json-file.
-func StaticFileSave(storeFile string) {
+// ExpireUpdate function removes the gauges that were not updated for longer than the ttl at regular intervals.
+// The storage is checked every half of the ttl, so gauges are removed within 1.5 ttl after the last update.
+// The before time of every successful run is passed to onExpire, e.g. to forget the activity of the removed gauges.
+// Nothing is done for non-positive ttl values.
+func ExpireUpdate(ttl time.Duration, st Storage, onExpire func(before time.Time)) {
 
-	file, err := os.OpenFile(storeFile, os.O_WRONLY|os.O_CREATE, 0777)
-	if err != nil {
-		log.Fatalf("Error happened in JSON file opening. Err: %s", err)
-	}
-	writer := bufio.NewWriter(file)
-
-	data, err := json.Marshal(&metrics.Container)
-	if err != nil {
-		log.Printf("Error happened in JSON marshal. Err: %s", err)
+	if ttl <= 0 {
 		return
 	}
-	if len(data) > 3 {
-		log.Print(string(data))
-		if _, err := writer.Write(data); err != nil {
-			log.Fatalf("Error happened when writing data to storage file. Err: %s", err)
-		}
+	ticker := time.NewTicker(ttl / 2)
+	defer ticker.Stop()
 
-		if err := writer.WriteByte('\n'); err != nil {
-			log.Fatalf("Error happened when writing data to storage file. Err: %s", err)
-		}
-		writer.Flush()
-	}
-	file.Close()
-	log.Printf("saved JSON to file")
-
-}
-
-// StaticFileUpload function uploads stored system metrics from the json-file.
-func StaticFileUpload(storeFile string) {
-
-	file, err := os.OpenFile(storeFile, os.O_RDONLY|os.O_CREATE, 0777)
-	if err != nil {
-		log.Fatalf("Error happened in JSON file opening. Err: %s", err)
+	for range ticker.C {
 
-	} else {
-		log.Printf("Uploading data from JSON")
-		reader := bufio.NewReader(file)
-		data, err := reader.ReadBytes('\n')
+		ctx, cancel := context.WithTimeout(context.Background(), config.ContextDBTimeout*time.Second)
+		before := time.Now().Add(-ttl)
+		expired, err := st.Expire(ctx, before)
+		cancel()
 		if err != nil {
-			log.Printf("Error happened in reading JSON file bytes. Err: %s", err)
-
-		} else {
-			err = json.Unmarshal([]byte(data), &metrics.Container)
-			log.Print(string(data))
-			if err != nil {
-				log.Printf("No JSON data to decode")
-			}
+			log.Printf("Error happened in removing stale gauges. Err: %s", err)
+			continue
 		}
-		file.Close()
-	}
-
-}
-
-// DBSave function performs the operation of inserting new system metrics to a SQL database with a query. 
-func DBSave(storeDB *sql.DB, metricsObj metrics.Metrics, ctx context.Context) error {
-
-	_, err := storeDB.ExecContext(ctx, "INSERT INTO metrics (name, value, delta) VALUES ($1, $2, $3);",
-		metricsObj.ID,
-		metricsObj.Value,
-		metricsObj.Delta,
-	)
-	if err != nil {
-		log.Printf("Error happened when inserting a new entry into sql table. Err: %s", err)
-		return err
-	}
-	log.Printf("saved metrics data to DB")
-	return nil
-}
-
-// DBSaveBatch function performs the operation of inserting a batch of system metrics to a SQL database with a transaction. 
-func DBSaveBatch(storeDB *sql.DB, metricsObj []metrics.Metrics, ctx context.Context) error {
-
-	// шаг 1 — объявляем транзакцию
-	tx, err := storeDB.Begin()
-	if err != nil {
-		log.Printf("Error happened when initiating sql transaction. Err: %s", err)
-		return err
-	}
-	// шаг 1.1 — если возникает ошибка, откатываем изменения
-	defer tx.Rollback()
-
-	// шаг 2 — готовим инструкцию
-	stmt, err := tx.PrepareContext(ctx, "INSERT INTO metrics (name, value, delta) VALUES ($1, $2, $3)")
-	if err != nil {
-		log.Printf("Error happened when preparing sql transaction context. Err: %s", err)
-		return err
-	}
-	// шаг 2.1 — не забываем закрыть инструкцию, когда она больше не нужна
-	defer stmt.Close()
-
-	for _, v := range metricsObj {
-		// шаг 3 — указываем, что каждое будет добавлено в транзакцию
-		if _, err = stmt.ExecContext(ctx, v.ID, v.Value, v.Delta); err != nil {
-			log.Printf("Error happened when declaring transaction. Err: %s", err)
-			return err
+		if onExpire != nil {
+			onExpire(before)
 		}
-	}
-	// шаг 4 — сохраняем изменения
-
-	return tx.Commit()
-}
-
-// DBUpload function performs the operation of retrieving system metrics from a SQL database with a query. 
-func DBUpload(storeDB *sql.DB, metricsObj metrics.Metrics, ctx context.Context) (metrics.Metrics, error) {
-
-	var uploadedValue *float64
-	var uploadedDelta *int64
-
-	err := storeDB.QueryRowContext(ctx, "WITH ranked_metrics AS (SELECT m.*, ROW_NUMBER() OVER (PARTITION BY name ORDER BY metrics_id DESC) AS rn FROM metrics AS m) SELECT value FROM ranked_metrics WHERE name = ($1) AND rn = 1;", metricsObj.ID).Scan(&uploadedValue)
-	if err != nil && err != sql.ErrNoRows {
-		log.Println("Error at first query")
-		log.Printf("Error happened when extracting delta entry from sql table. Err: %s", err)
-		return metricsObj, err
-	}
-	if uploadedValue == nil {
-		err := storeDB.QueryRowContext(ctx, "SELECT  SUM(delta) FROM metrics WHERE name=($1);", metricsObj.ID).Scan(&uploadedDelta)
-		log.Println("Error at second query")
-		if err != nil && err != sql.ErrNoRows {
-			log.Printf("Error happened when extracting delta entry from sql table. Err: %s", err)
-			return metricsObj, err
+		if expired > 0 {
+			log.Printf("Removed %d stale gauges", expired)
 		}
-		metricsObj.Delta = uploadedDelta
-	} else {
-		metricsObj.Value = uploadedValue
-	}
-	log.Printf("uploaded data from DB")
-	s, err := json.Marshal(metricsObj)
-	if err != nil {
-		log.Printf("Error happened in JSON marshal. Err: %s", err)
-		return metricsObj, err
-	}
-	log.Print(string(s))
-	return metricsObj, nil
-}
-
-// DBCheck function performs the operation of checking if a system metric was previously recorded to a SQL database with a query.
-func DBCheck(storeDB *sql.DB, name string, ctx context.Context) bool {
-
-	var ok bool
-	err := storeDB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM metrics WHERE name = ($1));", name).Scan(&ok)
-	if err != nil && err != sql.ErrNoRows {
-		log.Fatalf("Error happened when extracting entries from sql table. Err: %s", err)
-	}
-	log.Printf("checked for metrics in DB")
-	return ok
-}
-
-// ContainerUpdate function enables saving received system metrics to a json-file constantly at regular intervals.
-func ContainerUpdate(storeInt int, storeFile string, storeDB *sql.DB, storeParameter string) {
-
-	var ticker *time.Ticker
-	if strings.Contains(storeParameter, "m") {
-		ticker = time.NewTicker(time.Duration(storeInt) * 100 * time.Millisecond)
-	} else {
-		ticker = time.NewTicker(time.Duration(storeInt) * time.Second)
-	}
-
-	for range ticker.C {
-
-		StaticFileSave(storeFile)
 
 	}
 
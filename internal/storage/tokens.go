@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/auth"
+)
+
+// dbTokenStore keeps the tokens in the tokens table of the metrics database.
+type dbTokenStore struct {
+	ds *DBStorage
+}
+
+// TokenStore function returns the token store sharing the connection of the database storage.
+func (ds *DBStorage) TokenStore() auth.Store {
+
+	return dbTokenStore{ds: ds}
+}
+
+// Create function saves the new token.
+func (s dbTokenStore) Create(ctx context.Context, t auth.Token) error {
+
+	_, err := s.ds.db.ExecContext(ctx, "INSERT INTO tokens (id, name, scopes, instance, hash, created_at) VALUES ($1, $2, $3, $4, $5, $6);",
+		t.ID, t.Name, strings.Join(t.Scopes, ","), t.Instance, t.Hash, s.ds.dialect.timeArg(t.Created))
+	return err
+}
+
+// Lookup function returns the token with the secret hash.
+func (s dbTokenStore) Lookup(ctx context.Context, hash string) (auth.Token, error) {
+
+	row := s.ds.db.QueryRowContext(ctx, "SELECT id, name, scopes, instance, hash, created_at FROM tokens WHERE hash = ($1);", hash)
+	t, err := scanToken(row)
+	if err == sql.ErrNoRows {
+		return t, auth.ErrTokenNotFound
+	}
+	return t, err
+}
+
+// Revoke function removes the token.
+func (s dbTokenStore) Revoke(ctx context.Context, id string) error {
+
+	res, err := s.ds.db.ExecContext(ctx, "DELETE FROM tokens WHERE id = ($1);", id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return auth.ErrTokenNotFound
+	}
+	return nil
+}
+
+// List function returns all the tokens ordered by the creation time.
+func (s dbTokenStore) List(ctx context.Context) ([]auth.Token, error) {
+
+	rows, err := s.ds.db.QueryContext(ctx, "SELECT id, name, scopes, instance, hash, created_at FROM tokens ORDER BY created_at, id;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []auth.Token{}
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// rowScanner interface is implemented by sql.Row and sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanToken function reads the token from the query result row.
+func scanToken(row rowScanner) (auth.Token, error) {
+
+	var t auth.Token
+	var scopes string
+	var created dbTime
+	if err := row.Scan(&t.ID, &t.Name, &scopes, &t.Instance, &t.Hash, &created); err != nil {
+		return t, err
+	}
+	t.Scopes = strings.Split(scopes, ",")
+	t.Created = created.UTC()
+	return t, nil
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/metrics"
+)
+
+// WALSuffix is appended to the json-file name to get the write-ahead log file name.
+const WALSuffix = ".wal"
+
+// Operations recorded to the write-ahead log. Updates have no operation name to keep the earlier logs readable.
+const (
+	walUpdate = ""
+	walDelete = "delete"
+	walReset  = "reset"
+)
+
+// walRecord struct is a single line of the write-ahead log holding one accepted operation on a system metric or batch.
+// Seq numbers the records, the json-file snapshot keeps the number of the last record it covers.
+type walRecord struct {
+	Seq     uint64            `json:"seq,omitempty"`
+	Time    time.Time         `json:"time"`
+	Op      string            `json:"op,omitempty"`
+	Metrics []metrics.Metrics `json:"metrics"`
+}
+
+// walPath function returns the write-ahead log file name for the json-file.
+func walPath(storeFile string) string {
+
+	return storeFile + WALSuffix
+}
+
+// openWAL function opens an empty write-ahead log for appending.
+func openWAL(storeFile string) (*os.File, error) {
+
+	return os.OpenFile(walPath(storeFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+}
+
+// appendWAL function writes the accepted operation to the write-ahead log and syncs it to disk.
+func appendWAL(wal *os.File, record walRecord) error {
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = wal.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return wal.Sync()
+}
+
+// replayWAL function applies the system metrics recorded in the write-ahead log to the storage
+// and returns the number of applied records and the sequence number of the last one.
+// The records numbered up to after are already covered by the snapshot and are skipped,
+// the records written before the numbering was introduced have no number and are always applied.
+// Replay stops at the first incomplete or malformed record, which is the tail written during a crash.
+func replayWAL(storeFile string, ms *MemStorage, after uint64) (int, uint64, error) {
+
+	last := after
+	file, err := os.Open(walPath(storeFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, last, nil
+	}
+	if err != nil {
+		return 0, last, err
+	}
+	defer file.Close()
+
+	var replayed int
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("Skipping incomplete write-ahead log record")
+			}
+			return replayed, last, nil
+		}
+		if err != nil {
+			return replayed, last, err
+		}
+
+		var record walRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			log.Printf("Skipping malformed write-ahead log records. Err: %s", err)
+			return replayed, last, nil
+		}
+		if record.Seq != 0 && record.Seq <= after {
+			continue
+		}
+		if err = replayRecord(ms, record); err != nil {
+			log.Printf("Skipping invalid write-ahead log records. Err: %s", err)
+			return replayed, last, nil
+		}
+		replayed++
+		if record.Seq > last {
+			last = record.Seq
+		}
+	}
+}
+
+// replayRecord function applies a single write-ahead log record to the storage.
+func replayRecord(ms *MemStorage, record walRecord) error {
+
+	ctx := context.Background()
+	switch record.Op {
+	case walUpdate:
+		for _, mp := range record.Metrics {
+			if err := validate(mp); err != nil {
+				return err
+			}
+		}
+		// the metrics keep the time they were received at rather than the replay time
+		return ms.updateBatch(record.Metrics, record.Time)
+	case walDelete:
+		return ms.DeleteBatch(ctx, record.Metrics)
+	case walReset:
+		for _, mp := range record.Metrics {
+			if err := ms.Reset(ctx, mp); err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown operation %q", record.Op)
+}
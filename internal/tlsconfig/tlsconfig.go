@@ -0,0 +1,74 @@
+// Tlsconfig package contains the TLS configuration of the server and the agent built from PEM-encoded certificate files.
+//
+// Available at https://github.com/SiberianMonster/go-musthave-devops-tpl/internal/tlsconfig
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ServerConfig function returns the TLS configuration serving the certificate and its key.
+// When the client CA file is set only the clients presenting a certificate signed by that CA are admitted (mutual TLS).
+func ServerConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both certificate and key files are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		if cfg.ClientCAs, err = certPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// ClientConfig function returns the TLS configuration verifying the server with the CA and presenting the client certificate.
+// The system roots are used when the CA file is not set, the client certificate is optional.
+func ClientConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	var err error
+	if caFile != "" {
+		if cfg.RootCAs, err = certPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("both client certificate and key files are required")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// certPool function reads the PEM-encoded CA certificates from the file.
+func certPool(caFile string) (*x509.CertPool, error) {
+
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
@@ -0,0 +1,50 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/SiberianMonster/go-musthave-devops-tpl/internal/tlsconfig/tlstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerConfig(t *testing.T) {
+
+	files := tlstest.NewFiles(t)
+
+	cfg, err := ServerConfig(files.ServerCert, files.ServerKey, "")
+	require.NoError(t, err)
+	assert.Len(t, cfg.Certificates, 1)
+	assert.Equal(t, tls.NoClientCert, cfg.ClientAuth)
+
+	cfg, err = ServerConfig(files.ServerCert, files.ServerKey, files.CA)
+	require.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, cfg.ClientAuth)
+	assert.NotNil(t, cfg.ClientCAs)
+
+	_, err = ServerConfig(files.ServerCert, "", "")
+	assert.Error(t, err)
+	_, err = ServerConfig(files.ServerCert, files.ServerKey, files.ServerKey)
+	assert.Error(t, err)
+}
+
+func TestClientConfig(t *testing.T) {
+
+	files := tlstest.NewFiles(t)
+
+	cfg, err := ClientConfig("", "", "")
+	require.NoError(t, err)
+	assert.Nil(t, cfg.RootCAs)
+	assert.Empty(t, cfg.Certificates)
+
+	cfg, err = ClientConfig(files.CA, files.ClientCert, files.ClientKey)
+	require.NoError(t, err)
+	assert.NotNil(t, cfg.RootCAs)
+	assert.Len(t, cfg.Certificates, 1)
+
+	_, err = ClientConfig(files.CA, files.ClientCert, "")
+	assert.Error(t, err)
+	_, err = ClientConfig(files.ClientKey, "", "")
+	assert.Error(t, err)
+}
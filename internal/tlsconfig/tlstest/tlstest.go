@@ -0,0 +1,106 @@
+// Tlstest package generates the certificates used by the TLS tests in-process.
+//
+// Available at https://github.com/SiberianMonster/go-musthave-devops-tpl/internal/tlsconfig/tlstest
+package tlstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Files struct holds the paths of the generated PEM files.
+type Files struct {
+	// CA is the certificate of the authority signing all the other certificates.
+	CA string
+	// ServerCert and ServerKey are valid for localhost and 127.0.0.1.
+	ServerCert string
+	ServerKey  string
+	// ClientCert and ClientKey identify an agent.
+	ClientCert string
+	ClientKey  string
+}
+
+// NewFiles function generates a CA with a server and a client certificate and writes them to a temporary directory.
+func NewFiles(t testing.TB) Files {
+
+	t.Helper()
+	dir := t.TempDir()
+	ca, caKey := newCertificate(t, nil, nil, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, dir, "ca")
+	files := Files{CA: filepath.Join(dir, "ca.pem")}
+	newCertificate(t, ca, caKey, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, dir, "server")
+	files.ServerCert, files.ServerKey = filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	newCertificate(t, ca, caKey, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "agent"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, dir, "client")
+	files.ClientCert, files.ClientKey = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	return files
+}
+
+// newCertificate function signs the template with the parent certificate, a nil parent makes it self-signed.
+// The certificate and its key are written to name.pem and name-key.pem.
+func newCertificate(t testing.TB, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, template *x509.Certificate, dir, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	writePEM(t, filepath.Join(dir, name+"-key.pem"), "PRIVATE KEY", keyDER)
+	return cert, key
+}
+
+// writePEM function writes the PEM block to the file.
+func writePEM(t testing.TB, path, blockType string, der []byte) {
+
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}